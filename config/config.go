@@ -3,31 +3,290 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	DBHost         string
-	DBPort         string
-	DBUser         string
-	DBPassword     string
-	DBName         string
-	DBSSLMode      string
-	JWTSecret      string
-	Port           string
-	OpenRouterKey  string
+	DBHost                    string
+	DBPort                    string
+	DBUser                    string
+	DBPassword                string
+	DBName                    string
+	DBSSLMode                 string
+	JWTSecret                 string
+	Port                      string
+	OpenRouterKey             string
+	OpenRouterBaseURL         string
+	OpenAICompatibleProviders []ProviderConfig
+	OllamaBaseURL             string
+	FakeLLM                   FakeLLMConfig
+	ModelPricesFile           string
+	Quota                     QuotaConfig
+	GenerationRetention       time.Duration
+	Context                   ContextConfig
+	// TitleModel names chats after their first exchange; "none" keeps the
+	// truncated first message as the title.
+	TitleModel string
+	// DefaultModel is used when neither the request nor the chat names one.
+	DefaultModel string
+	Catalog      CatalogConfig
+	Attachments  AttachmentConfig
+	Tools        ToolsConfig
+	Retry        RetryConfig
+	Upstream     UpstreamConfig
+	Search       SearchConfig
+	Embeddings   EmbeddingConfig
+	// ResponseFormatRetries is how often a reply that does not match the
+	// requested response_format is retried before the generation fails.
+	ResponseFormatRetries int
+}
+
+// SearchConfig controls full-text search over chats and messages.
+type SearchConfig struct {
+	// Language is the PostgreSQL text search configuration used for
+	// stemming and stop words, such as "english" or "simple".
+	Language string
+}
+
+// EmbeddingConfig controls the embeddings behind semantic search. An empty
+// Provider disables it.
+type EmbeddingConfig struct {
+	// Provider is "openai" for any OpenAI-compatible /embeddings endpoint or
+	// "local" for the built-in hashing stub.
+	Provider string
+	BaseURL  string
+	APIKey   string
+	Model    string
+	// Dimensions is checked against the vectors returned by the model and
+	// sizes the local stub's vectors.
+	Dimensions int
+	BatchSize  int
+	// PollInterval is how often the worker looks for new or edited messages.
+	PollInterval time.Duration
+	// MaxChars truncates long messages before they are embedded.
+	MaxChars int
+}
+
+// UpstreamConfig bounds HTTP calls to LLM providers. A zero duration disables
+// the corresponding timeout.
+type UpstreamConfig struct {
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	// IdleTimeout fails a streaming response when no data arrives for this
+	// long, such as a provider that hangs mid-answer.
+	IdleTimeout time.Duration
+	// TotalTimeout bounds a whole call, including the streamed answer.
+	TotalTimeout        time.Duration
+	MaxIdleConnsPerHost int
+}
+
+// RetryConfig controls how generations recover from provider errors. Only
+// failures before the first streamed token are retried.
+type RetryConfig struct {
+	// MaxRetries is the number of retries per model after the first attempt.
+	MaxRetries int
+	// InitialBackoff doubles with every retry up to MaxBackoff; up to half
+	// of the delay is added as random jitter.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// FallbackModels are tried in order when a model keeps failing, for
+	// chats and personas without their own list.
+	FallbackModels []string
+}
+
+// ToolsConfig controls the server-side tools offered to models that support
+// function calling.
+type ToolsConfig struct {
+	Enabled bool
+	// Disabled lists built-in tools that are not offered.
+	Disabled []string
+	// MaxRounds bounds how many times a reply may call tools before the model
+	// must answer.
+	MaxRounds int
+}
+
+// AttachmentConfig selects where uploaded files are stored.
+type AttachmentConfig struct {
+	// Storage is "local" or "s3".
+	Storage  string
+	Dir      string
+	MaxBytes int64
+	S3       S3Config
+}
+
+// S3Config addresses an S3-compatible bucket (AWS, MinIO, R2, ...).
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key, as most self-hosted servers expect.
+	PathStyle bool
+}
+
+// CatalogConfig controls the model catalog served at /api/v1/models and which
+// models may be used.
+type CatalogConfig struct {
+	// File replaces the providers' model lists with a local JSON array of
+	// models, for offline deployments.
+	File string
+	TTL  time.Duration
+	// Allow and Deny hold model ids or glob patterns such as "openai/*",
+	// where * also matches "/". An empty allow list permits every model not
+	// denied.
+	Allow []string
+	Deny  []string
+}
+
+// ProviderConfig describes an additional OpenAI-compatible endpoint. Models
+// served by it are addressed as "<name>:<model>".
+type ProviderConfig struct {
+	Name    string
+	BaseURL string
+	APIKey  string
+}
+
+// FakeLLMConfig controls the built-in scripted provider used for tests and
+// offline development. Every setting can be overridden per request through the
+// model string, e.g. "fake:echo?chunk=2&latency=50ms&error_after=3".
+type FakeLLMConfig struct {
+	Enabled      bool
+	AsDefault    bool
+	Response     string
+	ChunkSize    int
+	Latency      time.Duration
+	ErrorAfter   int
+	FinishReason string
+}
+
+// QuotaConfig limits spending on the operator's shared OpenRouter key. A zero
+// value disables the corresponding limit.
+type QuotaConfig struct {
+	UserDailyTokens     int64
+	UserMonthlyTokens   int64
+	UserDailyCost       float64
+	UserMonthlyCost     float64
+	GlobalDailyTokens   int64
+	GlobalMonthlyTokens int64
+	GlobalDailyCost     float64
+	GlobalMonthlyCost   float64
+	// ApplyToUserKeys also enforces the per-user limits on calls made with
+	// the user's own key.
+	ApplyToUserKeys bool
+}
+
+// ContextConfig controls how chat history is fitted into a model's context
+// window.
+type ContextConfig struct {
+	// DefaultWindow is assumed for models whose context size is unknown.
+	DefaultWindow int
+	// ReserveTokens is kept free for the reply when a chat sets no max_tokens.
+	ReserveTokens int
+	// Strategy is used for chats without their own context_strategy.
+	Strategy string
+	// SummaryModel writes conversation summaries; empty uses the chat's model.
+	SummaryModel string
 }
 
 func Load() *Config {
 	return &Config{
-		DBHost:        getEnv("DB_HOST", "localhost"),
-		DBPort:        getEnv("DB_PORT", "5432"),
-		DBUser:        getEnv("DB_USER", "postgres"),
-		DBPassword:    getEnv("DB_PASSWORD", ""),
-		DBName:        getEnv("DB_NAME", "myapp"),
-		DBSSLMode:     getEnv("DB_SSLMODE", "disable"),
-		JWTSecret:     getEnv("JWT_SECRET", "default-secret"),
-		Port:          getEnv("PORT", "8080"),
-		OpenRouterKey: getEnv("OPENROUTER_API_KEY", ""),
+		DBHost:                    getEnv("DB_HOST", "localhost"),
+		DBPort:                    getEnv("DB_PORT", "5432"),
+		DBUser:                    getEnv("DB_USER", "postgres"),
+		DBPassword:                getEnv("DB_PASSWORD", ""),
+		DBName:                    getEnv("DB_NAME", "myapp"),
+		DBSSLMode:                 getEnv("DB_SSLMODE", "disable"),
+		JWTSecret:                 getEnv("JWT_SECRET", "default-secret"),
+		Port:                      getEnv("PORT", "8080"),
+		OpenRouterKey:             getEnv("OPENROUTER_API_KEY", ""),
+		OpenRouterBaseURL:         getEnv("OPENROUTER_BASE_URL", "https://openrouter.ai/api/v1"),
+		OpenAICompatibleProviders: loadProviders(),
+		OllamaBaseURL:             getEnv("OLLAMA_BASE_URL", ""),
+		FakeLLM: FakeLLMConfig{
+			Enabled:      getEnvBool("FAKE_LLM_ENABLED", false),
+			AsDefault:    getEnvBool("FAKE_LLM_AS_DEFAULT", false),
+			Response:     getEnv("FAKE_LLM_RESPONSE", "This is a canned response from the fake LLM provider."),
+			ChunkSize:    getEnvInt("FAKE_LLM_CHUNK_SIZE", 8),
+			Latency:      getEnvDuration("FAKE_LLM_LATENCY", 0),
+			ErrorAfter:   getEnvInt("FAKE_LLM_ERROR_AFTER", 0),
+			FinishReason: getEnv("FAKE_LLM_FINISH_REASON", "stop"),
+		},
+		ModelPricesFile:     getEnv("MODEL_PRICES_FILE", ""),
+		GenerationRetention: getEnvDuration("GENERATION_RETENTION", 5*time.Minute),
+		TitleModel:          getEnv("TITLE_MODEL", "google/gemini-2.0-flash-lite-001"),
+		DefaultModel:        getEnv("DEFAULT_MODEL", "google/gemini-2.0-flash-lite-001"),
+		Catalog: CatalogConfig{
+			File:  getEnv("MODEL_CATALOG_FILE", ""),
+			TTL:   getEnvDuration("MODEL_CATALOG_TTL", time.Hour),
+			Allow: splitList(getEnv("MODEL_ALLOWLIST", "")),
+			Deny:  splitList(getEnv("MODEL_DENYLIST", "")),
+		},
+		Attachments: AttachmentConfig{
+			Storage:  getEnv("ATTACHMENT_STORAGE", "local"),
+			Dir:      getEnv("ATTACHMENT_DIR", "./uploads"),
+			MaxBytes: int64(getEnvInt("ATTACHMENT_MAX_BYTES", 10<<20)),
+			S3: S3Config{
+				Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+				Region:    getEnv("S3_REGION", "us-east-1"),
+				Bucket:    getEnv("S3_BUCKET", ""),
+				AccessKey: getEnv("S3_ACCESS_KEY_ID", ""),
+				SecretKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+				PathStyle: getEnvBool("S3_PATH_STYLE", true),
+			},
+		},
+		ResponseFormatRetries: getEnvInt("RESPONSE_FORMAT_RETRIES", 1),
+		Tools: ToolsConfig{
+			Enabled:   getEnvBool("TOOLS_ENABLED", true),
+			Disabled:  splitList(getEnv("TOOLS_DISABLED", "")),
+			MaxRounds: getEnvInt("TOOLS_MAX_ROUNDS", 5),
+		},
+		Retry: RetryConfig{
+			MaxRetries:     getEnvInt("GENERATION_MAX_RETRIES", 2),
+			InitialBackoff: getEnvDuration("GENERATION_RETRY_BACKOFF", 500*time.Millisecond),
+			MaxBackoff:     getEnvDuration("GENERATION_RETRY_MAX_BACKOFF", 8*time.Second),
+			FallbackModels: splitList(getEnv("FALLBACK_MODELS", "")),
+		},
+		Upstream: UpstreamConfig{
+			ConnectTimeout:        getEnvDuration("LLM_CONNECT_TIMEOUT", 10*time.Second),
+			ResponseHeaderTimeout: getEnvDuration("LLM_RESPONSE_HEADER_TIMEOUT", 2*time.Minute),
+			IdleTimeout:           getEnvDuration("LLM_IDLE_TIMEOUT", 3*time.Minute),
+			TotalTimeout:          getEnvDuration("LLM_TOTAL_TIMEOUT", 20*time.Minute),
+			MaxIdleConnsPerHost:   getEnvInt("LLM_MAX_IDLE_CONNS_PER_HOST", 16),
+		},
+		Search: SearchConfig{
+			Language: getEnv("SEARCH_LANGUAGE", "english"),
+		},
+		Embeddings: EmbeddingConfig{
+			Provider:     getEnv("EMBEDDING_PROVIDER", ""),
+			BaseURL:      getEnv("EMBEDDING_BASE_URL", "https://api.openai.com/v1"),
+			APIKey:       getEnv("EMBEDDING_API_KEY", ""),
+			Model:        getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+			Dimensions:   getEnvInt("EMBEDDING_DIMENSIONS", 1536),
+			BatchSize:    getEnvInt("EMBEDDING_BATCH_SIZE", 32),
+			PollInterval: getEnvDuration("EMBEDDING_POLL_INTERVAL", 10*time.Second),
+			MaxChars:     getEnvInt("EMBEDDING_MAX_CHARS", 8000),
+		},
+		Context: ContextConfig{
+			DefaultWindow: getEnvInt("CONTEXT_DEFAULT_WINDOW", 8192),
+			ReserveTokens: getEnvInt("CONTEXT_RESERVE_TOKENS", 1024),
+			Strategy:      getEnv("CONTEXT_STRATEGY", "truncate"),
+			SummaryModel:  getEnv("CONTEXT_SUMMARY_MODEL", ""),
+		},
+		Quota: QuotaConfig{
+			UserDailyTokens:     int64(getEnvInt("QUOTA_USER_DAILY_TOKENS", 0)),
+			UserMonthlyTokens:   int64(getEnvInt("QUOTA_USER_MONTHLY_TOKENS", 0)),
+			UserDailyCost:       getEnvFloat("QUOTA_USER_DAILY_COST", 0),
+			UserMonthlyCost:     getEnvFloat("QUOTA_USER_MONTHLY_COST", 0),
+			GlobalDailyTokens:   int64(getEnvInt("QUOTA_GLOBAL_DAILY_TOKENS", 0)),
+			GlobalMonthlyTokens: int64(getEnvInt("QUOTA_GLOBAL_MONTHLY_TOKENS", 0)),
+			GlobalDailyCost:     getEnvFloat("QUOTA_GLOBAL_DAILY_COST", 0),
+			GlobalMonthlyCost:   getEnvFloat("QUOTA_GLOBAL_MONTHLY_COST", 0),
+			ApplyToUserKeys:     getEnvBool("QUOTA_APPLY_TO_USER_KEYS", false),
+		},
 	}
 }
 
@@ -36,9 +295,66 @@ func (c *Config) DatabaseURL() string {
 		c.DBHost, c.DBPort, c.DBUser, c.DBPassword, c.DBName, c.DBSSLMode)
 }
 
+// loadProviders reads LLM_PROVIDERS (comma separated names) and, for each
+// name, LLM_PROVIDER_<NAME>_BASE_URL and LLM_PROVIDER_<NAME>_API_KEY.
+func loadProviders() []ProviderConfig {
+	var providers []ProviderConfig
+	for _, name := range splitList(getEnv("LLM_PROVIDERS", "")) {
+		prefix := "LLM_PROVIDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		baseURL := getEnv(prefix+"_BASE_URL", "")
+		if baseURL == "" {
+			continue
+		}
+		providers = append(providers, ProviderConfig{
+			Name:    name,
+			BaseURL: baseURL,
+			APIKey:  getEnv(prefix+"_API_KEY", ""),
+		})
+	}
+	return providers
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if trimmed := strings.TrimSpace(item); trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
+}
+
 func getEnv(key, defaultVal string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultVal
 }
+
+func getEnvBool(key string, defaultVal bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultVal
+}
+
+func getEnvInt(key string, defaultVal int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultVal
+}
+
+func getEnvFloat(key string, defaultVal float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultVal
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultVal
+}
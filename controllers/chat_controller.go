@@ -1,43 +1,80 @@
 package controllers
 
 import (
+	"errors"
 	"kapi/config"
 	"kapi/models"
 	"kapi/services"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type ChatController struct {
-	db          *gorm.DB
-	cfg         *config.Config
-	chatService *services.ChatService
-	hubService  *services.HubService
-	userService *services.UserService
+	db           *gorm.DB
+	cfg          *config.Config
+	chatService  *services.ChatService
+	hubService   *services.HubService
+	userService  *services.UserService
+	quotaService *services.QuotaService
 }
 
-func NewChatController(db *gorm.DB, cfg *config.Config, hubService *services.HubService) *ChatController {
+func NewChatController(db *gorm.DB, cfg *config.Config, hubService *services.HubService, providers *services.ProviderRegistry, usageService *services.UsageService, quotaService *services.QuotaService, generations *services.GenerationService, contextSizes *services.ContextSizes, catalog *services.ModelCatalog, attachments *services.AttachmentService, tools *services.ToolRegistry) *ChatController {
 	userService := services.NewUserService(db)
+	personaService := services.NewPersonaService(db)
+	contextBuilder := services.NewContextBuilder(db, contextSizes, attachments, cfg.Context)
 	return &ChatController{
-		db:          db,
-		chatService: services.NewChatService(db, cfg.OpenRouterKey, userService),
-		hubService:  hubService,
-		userService: userService,
+		db:           db,
+		cfg:          cfg,
+		chatService:  services.NewChatService(db, cfg.OpenRouterKey, userService, personaService, providers, usageService, quotaService, generations, contextBuilder, attachments, tools, hubService, cfg.TitleModel, catalog, cfg.ResponseFormatRetries, cfg.Retry),
+		hubService:   hubService,
+		userService:  userService,
+		quotaService: quotaService,
 	}
 }
 
 func (cc *ChatController) getUserID(c *gin.Context) (uint, bool) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		return 0, false
+	return getUserID(c)
+}
+
+// checkQuota enforces spending limits before a generation with model starts
+// in the chat and exposes the remaining allowance as response headers. It
+// returns false after writing an error response.
+func (cc *ChatController) checkQuota(c *gin.Context, userID, chatID uint, model string) bool {
+	status, err := cc.chatService.CheckQuota(chatID, userID, model)
+	setQuotaHeaders(c, status)
+	if err == nil {
+		return true
 	}
-	if id, ok := userID.(uint); ok {
-		return id, true
+
+	if !quotaError(c, err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check usage quota"})
 	}
-	return 0, false
+	return false
+}
+
+// quotaError writes the response for an exceeded quota. It returns false if
+// err is not a quota error.
+func quotaError(c *gin.Context, err error) bool {
+	var quotaErr *services.QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(quotaErr.ResetAt).Seconds())+1))
+	c.JSON(quotaErr.StatusCode(), gin.H{
+		"error": quotaErr.Error(),
+		"quota": gin.H{
+			"scope":    quotaErr.Scope,
+			"period":   quotaErr.Period,
+			"kind":     quotaErr.Kind,
+			"reset_at": quotaErr.ResetAt,
+		},
+	})
+	return true
 }
 
 // CreateDirectMessage creates a new chat with an initial user message (synchronous)
@@ -48,32 +85,41 @@ func (cc *ChatController) CreateDirectMessage(c *gin.Context) {
 		return
 	}
 
-	hasKey, err := cc.userService.HasOpenRouterKey(userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
-		return
-	}
-
-	if !hasKey {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Please add your OpenRouter API key first"})
-		return
-	}
-
 	var req models.CreateDirectMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if cc.chatService.RequiresOpenRouterKey(req.Model) {
+		hasKey, err := cc.userService.HasOpenRouterKey(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
+			return
+		}
+
+		if !hasKey {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Please add your OpenRouter API key first"})
+			return
+		}
+	}
+
 	messageReq := &models.CreateMessageRequest{
-		Content: req.Content,
-		Role:    "user",
-		Model:   req.Model,
+		Content:       req.Content,
+		Role:          "user",
+		Model:         req.Model,
+		AttachmentIDs: req.AttachmentIDs,
 	}
 
-	chatResponse, err := cc.chatService.CreateChatWithMessageSync(userID, messageReq)
+	chatResponse, err := cc.chatService.CreateChatWithMessageSync(userID, messageReq, req.PersonaID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat: " + err.Error()})
+		if err.Error() == "persona not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+		} else if err.Error() == "attachment not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment not found or already sent"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat: " + err.Error()})
+		}
 		return
 	}
 
@@ -101,47 +147,94 @@ func (cc *ChatController) CreateDirectMessageStream(c *gin.Context) {
 	}
 
 	var req struct {
-		Model string `json:"model"`
+		Model          string                 `json:"model"`
+		ResponseFormat *models.ResponseFormat `json:"response_format"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.Header("Content-Type", "text/plain; charset=utf-8")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Headers", "Cache-Control")
-	c.Status(http.StatusOK)
+	if !cc.checkQuota(c, userID, uint(chatIDUint), req.Model) {
+		return
+	}
 
-	responseChan := make(chan string, 100)
-	errorChan := make(chan error, 1)
+	gen, err := cc.chatService.StartGeneration(uint(chatIDUint), userID, services.GenerationOptions{
+		Model:          req.Model,
+		ResponseFormat: req.ResponseFormat,
+	})
+	if err != nil {
+		cc.generationError(c, err)
+		return
+	}
 
-	go cc.chatService.StreamLLMResponse(uint(chatIDUint), userID, req.Model, responseChan, errorChan)
+	cc.streamGeneration(c, gen, nil, 0)
+}
 
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+// CompareModels adds a user message to a chat and answers it with several
+// models at once. The replies are streamed together as Server-Sent Events
+// and stored as alternatives of the same turn.
+func (cc *ChatController) CompareModels(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	for {
-		select {
-		case content, ok := <-responseChan:
-			if !ok {
-				return
-			}
-			c.Writer.WriteString(content)
-			flusher.Flush()
-		case err := <-errorChan:
-			if err != nil {
-				c.Writer.WriteString("\n\nError: " + err.Error())
-				flusher.Flush()
-				return
-			}
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req models.CompareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, model := range req.Models {
+		if !cc.checkQuota(c, userID, uint(chatID), model) {
+			return
 		}
 	}
+	opts := services.GenerationOptions{
+		ClientID:       req.ClientID,
+		ResponseFormat: req.ResponseFormat,
+	}
+	if err := cc.chatService.ValidateGeneration(uint(chatID), userID, req.Models, opts); err != nil {
+		cc.generationError(c, err)
+		return
+	}
+
+	userMessage, err := cc.chatService.CreateMessage(uint(chatID), userID, &models.CreateMessageRequest{
+		Content:       req.Content,
+		Role:          "user",
+		ClientID:      req.ClientID,
+		AttachmentIDs: req.AttachmentIDs,
+	})
+	if err != nil {
+		if err.Error() == "chat not found or access denied" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		} else if err.Error() == "attachment not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment not found or already sent"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message: " + err.Error()})
+		}
+		return
+	}
+
+	opts.ParentID = userMessage.ID
+	gens, err := cc.chatService.StartComparison(uint(chatID), userID, req.Models, opts)
+	if err != nil {
+		cc.discardMessage(userID, userMessage)
+		cc.generationError(c, err)
+		return
+	}
+
+	cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", userMessage, req.ClientID)
+
+	cc.streamComparison(c, gens, userMessage)
 }
 
 // GetUserChats retrieves all chats for the authenticated user
@@ -160,6 +253,9 @@ func (cc *ChatController) GetUserChats(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chats"})
 		return
 	}
+	for i := range chats {
+		chats[i].LastMessage = withoutReasoning(c, chats[i].LastMessage)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"data": chats,
@@ -171,7 +267,8 @@ func (cc *ChatController) GetUserChats(c *gin.Context) {
 	})
 }
 
-// GetChat retrieves a specific chat with messages
+// GetChat retrieves a specific chat with the messages of its active branch
+// (or the branch ending at ?leaf=), or every message as a tree with ?view=tree
 func (cc *ChatController) GetChat(c *gin.Context) {
 	userID, exists := cc.getUserID(c)
 	if !exists {
@@ -185,12 +282,34 @@ func (cc *ChatController) GetChat(c *gin.Context) {
 		return
 	}
 
-	chat, err := cc.chatService.GetChatByID(uint(chatID), userID)
+	if c.Query("view") == "tree" {
+		tree, err := cc.chatService.GetChatTree(uint(chatID), userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return
+		}
+
+		hideTreeReasoning(c, tree.Tree)
+		c.JSON(http.StatusOK, gin.H{"data": tree})
+		return
+	}
+
+	var leafID uint64
+	if leaf := c.Query("leaf"); leaf != "" {
+		leafID, err = strconv.ParseUint(leaf, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid leaf message ID"})
+			return
+		}
+	}
+
+	chat, err := cc.chatService.GetChatByID(uint(chatID), userID, uint(leafID))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
 		return
 	}
 
+	hideReasoning(c, chat.Messages)
 	c.JSON(http.StatusOK, gin.H{"data": chat})
 }
 
@@ -220,6 +339,8 @@ func (cc *ChatController) UpdateChat(c *gin.Context) {
 		return
 	}
 
+	cc.hubService.BroadcastToUser(userID, "chat_updated", chat)
+
 	c.JSON(http.StatusOK, gin.H{"data": chat})
 }
 
@@ -265,72 +386,49 @@ func (cc *ChatController) CreateMessage(c *gin.Context) {
 		return
 	}
 
+	opts := services.GenerationOptions{
+		Model:          req.Model,
+		ClientID:       req.ClientID,
+		ResponseFormat: req.ResponseFormat,
+	}
+	if req.Role == "user" {
+		if !cc.checkQuota(c, userID, uint(chatID), req.Model) {
+			return
+		}
+		if err := cc.chatService.ValidateGeneration(uint(chatID), userID, nil, opts); err != nil {
+			cc.generationError(c, err)
+			return
+		}
+	}
+
 	userMessage, err := cc.chatService.CreateMessage(uint(chatID), userID, &req)
 	if err != nil {
 		if err.Error() == "chat not found or access denied" {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		} else if err.Error() == "attachment not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment not found or already sent"})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message: " + err.Error()})
 		}
 		return
 	}
 
-	cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", userMessage, req.ClientID)
-
-	if req.Role == "user" {
-		c.Header("Content-Type", "text/plain; charset=utf-8")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Headers", "Cache-Control")
-
-		c.Status(http.StatusOK)
-
-		responseChan := make(chan string, 100)
-		errorChan := make(chan error, 1)
-		doneChan := make(chan struct{})
-
-		go func() {
-			defer close(doneChan)
-			llmMessage, err := cc.chatService.StreamLLMResponse(uint(chatID), userID, req.Model, responseChan, errorChan)
-			if err != nil {
-				return
-			}
-			if llmMessage != nil {
-				cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", llmMessage, req.ClientID)
-			}
-		}()
+	if req.Role != "user" {
+		cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", userMessage, req.ClientID)
+		c.JSON(http.StatusCreated, gin.H{"data": userMessage})
+		return
+	}
 
-		flusher, ok := c.Writer.(http.Flusher)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
-			return
-		}
+	gen, err := cc.chatService.StartGeneration(uint(chatID), userID, opts)
+	if err != nil {
+		cc.discardMessage(userID, userMessage)
+		cc.generationError(c, err)
+		return
+	}
 
-		for {
-			select {
-			case content, ok := <-responseChan:
-				if !ok {
-					return
-				}
-				c.Writer.WriteString(content)
-				flusher.Flush()
+	cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", userMessage, req.ClientID)
 
-			case err := <-errorChan:
-				if err != nil {
-					c.Writer.WriteString("\n\nError: " + err.Error())
-					flusher.Flush()
-					return
-				}
-			case <-doneChan:
-				return
-			case <-c.Request.Context().Done():
-				return
-			}
-		}
-	} else {
-		c.JSON(http.StatusCreated, gin.H{"data": userMessage})
-	}
+	cc.streamGeneration(c, gen, userMessage, 0)
 }
 
 // GetChatMessages retrieves all messages for a specific chat
@@ -360,6 +458,7 @@ func (cc *ChatController) GetChatMessages(c *gin.Context) {
 		return
 	}
 
+	hideReasoning(c, messages)
 	c.JSON(http.StatusOK, gin.H{
 		"data": messages,
 		"pagination": gin.H{
@@ -390,14 +489,23 @@ func (cc *ChatController) UpdateMessage(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		Content string `json:"content" binding:"required,min=1"`
-	}
+	var req models.UpdateMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	existing, err := cc.chatService.GetMessage(uint(messageID), uint(chatID), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if existing.Role == "user" {
+		cc.editUserMessage(c, userID, uint(chatID), uint(messageID), &req)
+		return
+	}
+
 	message, err := cc.chatService.UpdateMessage(uint(messageID), uint(chatID), userID, req.Content)
 	if err != nil {
 		if err.Error() == "chat not found or access denied" || err.Error() == "message not found" {
@@ -408,7 +516,46 @@ func (cc *ChatController) UpdateMessage(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": message})
+	c.JSON(http.StatusOK, gin.H{"data": withoutReasoning(c, message)})
+}
+
+// editUserMessage forks the chat at a user message and streams the reply to
+// the edited prompt.
+func (cc *ChatController) editUserMessage(c *gin.Context, userID, chatID, messageID uint, req *models.UpdateMessageRequest) {
+	if !cc.checkQuota(c, userID, chatID, req.Model) {
+		return
+	}
+	opts := services.GenerationOptions{
+		Model:          req.Model,
+		ClientID:       req.ClientID,
+		ResponseFormat: req.ResponseFormat,
+	}
+	if err := cc.chatService.ValidateGeneration(chatID, userID, nil, opts); err != nil {
+		cc.generationError(c, err)
+		return
+	}
+
+	edited, err := cc.chatService.EditMessage(messageID, chatID, userID, req.Content)
+	if err != nil {
+		if err.Error() == "chat not found or access denied" || err.Error() == "message not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+		}
+		return
+	}
+
+	opts.ParentID = edited.ID
+	gen, err := cc.chatService.StartGeneration(chatID, userID, opts)
+	if err != nil {
+		cc.discardMessage(userID, edited)
+		cc.generationError(c, err)
+		return
+	}
+
+	cc.hubService.BroadcastToUserExceptByClientID(userID, "message_created", edited, req.ClientID)
+
+	cc.streamGeneration(c, gen, edited, 0)
 }
 
 // DeleteMessage deletes a specific message
@@ -442,3 +589,457 @@ func (cc *ChatController) DeleteMessage(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully"})
 }
+
+// RegenerateMessage generates a new alternative for an assistant reply and
+// streams it like CreateMessage. Earlier replies are kept as alternatives.
+func (cc *ChatController) RegenerateMessage(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req models.RegenerateMessageRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if !cc.checkQuota(c, userID, uint(chatID), req.Model) {
+		return
+	}
+
+	gen, err := cc.chatService.RegenerateMessage(uint(messageID), uint(chatID), userID, services.GenerationOptions{
+		Model:          req.Model,
+		ClientID:       req.ClientID,
+		ResponseFormat: req.ResponseFormat,
+	})
+	if err != nil {
+		cc.generationError(c, err)
+		return
+	}
+
+	cc.streamGeneration(c, gen, nil, 0)
+}
+
+// ListAlternatives returns all replies generated for the same turn as a message
+func (cc *ChatController) ListAlternatives(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	alternatives, err := cc.chatService.ListAlternatives(uint(messageID), uint(chatID), userID)
+	if err != nil {
+		if err.Error() == "chat not found or access denied" || err.Error() == "message not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve alternatives"})
+		}
+		return
+	}
+
+	hideReasoning(c, alternatives)
+	c.JSON(http.StatusOK, gin.H{"data": alternatives})
+}
+
+// SelectAlternative makes a reply the active alternative for its turn
+func (cc *ChatController) SelectAlternative(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if cc.chatService.IsGenerating(uint(chatID), userID) {
+		cc.generationError(c, services.ErrGenerationInProgress)
+		return
+	}
+
+	message, err := cc.chatService.SelectAlternative(uint(messageID), uint(chatID), userID)
+	if err != nil {
+		if err.Error() == "chat not found or access denied" || err.Error() == "message not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to select alternative"})
+		}
+		return
+	}
+
+	selected := *message
+	selected.Reasoning = ""
+	cc.hubService.BroadcastToUser(userID, "message_selected", &selected)
+
+	c.JSON(http.StatusOK, gin.H{"data": withoutReasoning(c, message)})
+}
+
+// CancelGeneration stops the response currently being generated for a chat
+func (cc *ChatController) CancelGeneration(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := cc.chatService.CancelGeneration(uint(chatID), userID); err != nil {
+		if errors.Is(err, services.ErrNoActiveGeneration) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel generation"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Generation cancelled"})
+}
+
+// StreamGeneration attaches to the chat's running (or just finished)
+// generation and replays it from the given byte offset (?offset= or, for SSE
+// clients, Last-Event-ID) before following it live. ?message_id= picks one
+// reply of a comparison. When no generation is tracked anymore the latest
+// assistant reply (or the requested one) is served from the database.
+func (cc *ChatController) StreamGeneration(c *gin.Context) {
+	userID, exists := cc.getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	chatID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	offset, err := streamOffset(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	var messageID uint64
+	if raw := c.Query("message_id"); raw != "" {
+		messageID, err = strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+			return
+		}
+	}
+
+	if gen, ok := cc.chatService.GetGeneration(uint(chatID), userID, uint(messageID)); ok {
+		cc.streamGeneration(c, gen, nil, offset)
+		return
+	}
+
+	var message *models.Message
+	if messageID != 0 {
+		message, err = cc.chatService.GetMessage(uint(messageID), uint(chatID), userID)
+	} else {
+		message, err = cc.chatService.GetLatestAssistantMessage(uint(chatID), userID)
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No generation found for this chat"})
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	if offset > len(message.Content) {
+		offset = len(message.Content)
+	}
+
+	w := newGenerationWriter(c, flusher)
+	w.start(streamStart{
+		ChatID:             message.ChatID,
+		AssistantMessageID: message.ID,
+		Model:              message.Model,
+		Offset:             offset,
+	})
+	if offset < len(message.Content) {
+		w.delta(services.GenerationEvent{Content: message.Content[offset:], Offset: offset})
+	}
+	if message.Status == models.MessageStatusError {
+		w.fail(errors.New(message.Error), withoutReasoning(c, message))
+		return
+	}
+	w.end(withoutReasoning(c, message))
+}
+
+// streamGeneration writes a generation to the response, starting at offset,
+// until it finishes or the client goes away. A client disconnect does not
+// stop the generation.
+func (cc *ChatController) streamGeneration(c *gin.Context, gen *services.Generation, userMessage *models.Message, offset int) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	replay, events, unsubscribe := gen.Subscribe(offset)
+	defer unsubscribe()
+
+	w := newGenerationWriter(c, flusher)
+	w.start(streamStart{
+		ChatID:             gen.ChatID,
+		GenerationID:       gen.ID,
+		AssistantMessageID: gen.MessageID,
+		Model:              gen.Model,
+		Offset:             offset,
+		UserMessage:        userMessage,
+	})
+
+	if replay != "" {
+		w.delta(services.GenerationEvent{Content: replay, Offset: offset})
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case services.GenerationEventDelta:
+				w.delta(event)
+			case services.GenerationEventReasoning:
+				w.reasoning(event)
+			case services.GenerationEventToolCall, services.GenerationEventToolResult:
+				event.Message = withoutReasoning(c, event.Message)
+				w.tool(event)
+			case services.GenerationEventFormatRetry:
+				w.formatRetry(event)
+			case services.GenerationEventReset:
+				w.reset()
+			case services.GenerationEventRetry, services.GenerationEventFallback:
+				w.retry(event)
+			case services.GenerationEventError:
+				w.fail(event.Err, withoutReasoning(c, event.Message))
+				return
+			case services.GenerationEventDone:
+				w.end(withoutReasoning(c, event.Message))
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// comparisonEvent is an event of one of the generations of a comparison.
+// closed is set once the generation's subscription has ended.
+type comparisonEvent struct {
+	index  int
+	event  services.GenerationEvent
+	closed bool
+}
+
+// streamComparison writes the generations of a comparison as one SSE stream
+// until all of them finish or the client goes away. Events are those of a
+// single reply, with the reply's "index" and "model" added.
+func (cc *ChatController) streamComparison(c *gin.Context, gens []*services.Generation, userMessage *models.Message) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	setSSEHeaders(c)
+	w := &sseWriter{c: c, flusher: flusher}
+
+	replies := make([]gin.H, len(gens))
+	writers := make([]*sseWriter, len(gens))
+	for i, gen := range gens {
+		replies[i] = gin.H{
+			"index":                i,
+			"model":                gen.Model,
+			"generation_id":        gen.ID,
+			"assistant_message_id": gen.MessageID,
+		}
+		writers[i] = &sseWriter{c: c, flusher: flusher, fields: gin.H{"index": i, "model": gen.Model}}
+	}
+
+	c.Status(http.StatusOK)
+	c.Writer.WriteString("retry: 2000\n\n")
+	w.write("", "compare_start", gin.H{
+		"chat_id":       gens[0].ChatID,
+		"comparison_id": gens[0].ComparisonID,
+		"user_message":  userMessage,
+		"replies":       replies,
+	})
+
+	// Fan the subscriptions in so that events are written by this goroutine
+	// only.
+	merged := make(chan comparisonEvent)
+	stop := make(chan struct{})
+	defer close(stop)
+	for i, gen := range gens {
+		_, events, unsubscribe := gen.Subscribe(0)
+		defer unsubscribe()
+
+		go func(index int, events <-chan services.GenerationEvent) {
+			for event := range events {
+				select {
+				case merged <- comparisonEvent{index: index, event: event}:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case merged <- comparisonEvent{index: index, closed: true}:
+			case <-stop:
+			}
+		}(i, events)
+	}
+
+	for pending := len(gens); pending > 0; {
+		select {
+		case item := <-merged:
+			if item.closed {
+				pending--
+				continue
+			}
+			reply := writers[item.index]
+			event := item.event
+			switch event.Type {
+			case services.GenerationEventDelta:
+				reply.delta(event)
+			case services.GenerationEventReasoning:
+				reply.reasoning(event)
+			case services.GenerationEventToolCall, services.GenerationEventToolResult:
+				event.Message = withoutReasoning(c, event.Message)
+				reply.tool(event)
+			case services.GenerationEventFormatRetry:
+				reply.formatRetry(event)
+			case services.GenerationEventReset:
+				reply.reset()
+			case services.GenerationEventRetry, services.GenerationEventFallback:
+				reply.retry(event)
+			case services.GenerationEventError:
+				reply.fail(event.Err, withoutReasoning(c, event.Message))
+			case services.GenerationEventDone:
+				reply.end(withoutReasoning(c, event.Message))
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+
+	w.write("", "compare_end", gin.H{"comparison_id": gens[0].ComparisonID})
+}
+
+// discardMessage removes a user message saved for a generation that then
+// failed to start, which can happen when another request won a race.
+func (cc *ChatController) discardMessage(userID uint, message *models.Message) {
+	if err := cc.chatService.DeleteMessage(message.ID, message.ChatID, userID); err != nil {
+		log.Printf("Failed to remove message %d: %v", message.ID, err)
+	}
+}
+
+func (cc *ChatController) generationError(c *gin.Context, err error) {
+	if quotaError(c, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, services.ErrGenerationInProgress):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrModelNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotAssistantMessage), errors.Is(err, services.ErrInvalidResponseFormat):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err.Error() == "chat not found or access denied":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+	case err.Error() == "message not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start generation: " + err.Error()})
+	}
+}
+
+// includeReasoning reports whether the client asked for stored model
+// reasoning with ?include_reasoning=true.
+func includeReasoning(c *gin.Context) bool {
+	include, _ := strconv.ParseBool(c.Query("include_reasoning"))
+	return include
+}
+
+// hideReasoning clears the reasoning of messages unless the client asked for
+// it.
+func hideReasoning(c *gin.Context, messages []models.Message) {
+	if includeReasoning(c) {
+		return
+	}
+	for i := range messages {
+		messages[i].Reasoning = ""
+	}
+}
+
+func hideTreeReasoning(c *gin.Context, nodes []*models.MessageNode) {
+	if includeReasoning(c) {
+		return
+	}
+	for _, node := range nodes {
+		node.Reasoning = ""
+		hideTreeReasoning(c, node.Children)
+	}
+}
+
+// withoutReasoning is like hideReasoning for a single message. It returns a
+// copy, as generation results are shared between subscribers.
+func withoutReasoning(c *gin.Context, message *models.Message) *models.Message {
+	if message == nil || message.Reasoning == "" || includeReasoning(c) {
+		return message
+	}
+	hidden := *message
+	hidden.Reasoning = ""
+	return &hidden
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"kapi/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getUserID returns the authenticated user's id set by middleware.AuthRequired.
+func getUserID(c *gin.Context) (uint, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		return 0, false
+	}
+	if id, ok := userID.(uint); ok {
+		return id, true
+	}
+	return 0, false
+}
+
+// setQuotaHeaders exposes the remaining quota on the response when limits are
+// enforced for the request.
+func setQuotaHeaders(c *gin.Context, status *models.QuotaStatus) {
+	if status == nil || !status.Enforced {
+		return
+	}
+	if status.DailyTokensRemaining != nil {
+		c.Header("X-Quota-Daily-Tokens-Remaining", strconv.FormatInt(*status.DailyTokensRemaining, 10))
+	}
+	if status.MonthlyTokensRemaining != nil {
+		c.Header("X-Quota-Monthly-Tokens-Remaining", strconv.FormatInt(*status.MonthlyTokensRemaining, 10))
+	}
+	if status.DailyCostRemaining != nil {
+		c.Header("X-Quota-Daily-Cost-Remaining", strconv.FormatFloat(*status.DailyCostRemaining, 'f', 6, 64))
+	}
+	if status.MonthlyCostRemaining != nil {
+		c.Header("X-Quota-Monthly-Cost-Remaining", strconv.FormatFloat(*status.MonthlyCostRemaining, 'f', 6, 64))
+	}
+}
+
+func setStreamHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Headers", "Cache-Control")
+}
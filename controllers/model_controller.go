@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"kapi/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ModelController struct {
+	catalog *services.ModelCatalog
+}
+
+func NewModelController(catalog *services.ModelCatalog) *ModelController {
+	return &ModelController{catalog: catalog}
+}
+
+// GetModels returns the models available on this server, optionally filtered
+// by ?provider=
+func (mc *ModelController) GetModels(c *gin.Context) {
+	models, err := mc.catalog.Models(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load model catalog: " + err.Error()})
+		return
+	}
+
+	if provider := c.Query("provider"); provider != "" {
+		filtered := make([]services.ModelInfo, 0, len(models))
+		for _, m := range models {
+			if m.Provider == provider {
+				filtered = append(filtered, m)
+			}
+		}
+		models = filtered
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":          models,
+		"default_model": mc.catalog.DefaultModel(),
+	})
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"kapi/models"
+	"kapi/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type PersonaController struct {
+	db             *gorm.DB
+	personaService *services.PersonaService
+}
+
+func NewPersonaController(db *gorm.DB) *PersonaController {
+	return &PersonaController{
+		db:             db,
+		personaService: services.NewPersonaService(db),
+	}
+}
+
+// GetPersonas lists the authenticated user's personas
+func (pc *PersonaController) GetPersonas(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	personas, err := pc.personaService.ListPersonas(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve personas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": personas})
+}
+
+// GetPersona retrieves a single persona
+func (pc *PersonaController) GetPersona(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	personaID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid persona ID"})
+		return
+	}
+
+	persona, err := pc.personaService.GetPersona(uint(personaID), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": persona})
+}
+
+// CreatePersona creates a persona; marking it as default unsets the previous one
+func (pc *PersonaController) CreatePersona(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req models.CreatePersonaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	persona, err := pc.personaService.CreatePersona(userID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create persona"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": persona})
+}
+
+// UpdatePersona updates a persona's name, default flag or settings
+func (pc *PersonaController) UpdatePersona(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	personaID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid persona ID"})
+		return
+	}
+
+	var req models.UpdatePersonaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	persona, err := pc.personaService.UpdatePersona(uint(personaID), userID, &req)
+	if err != nil {
+		if err.Error() == "persona not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update persona"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": persona})
+}
+
+// DeletePersona deletes a persona; chats using it fall back to their own settings
+func (pc *PersonaController) DeletePersona(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	personaID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid persona ID"})
+		return
+	}
+
+	if err := pc.personaService.DeletePersona(uint(personaID), userID); err != nil {
+		if err.Error() == "persona not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete persona"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Persona deleted successfully"})
+}
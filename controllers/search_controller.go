@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"errors"
+	"kapi/models"
+	"kapi/services"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxSearchLimit = 100
+
+type SearchController struct {
+	searchService    *services.SearchService
+	embeddingService *services.EmbeddingService
+}
+
+func NewSearchController(searchService *services.SearchService, embeddingService *services.EmbeddingService) *SearchController {
+	return &SearchController{searchService: searchService, embeddingService: embeddingService}
+}
+
+// Search returns the authenticated user's chats and messages matching ?q=,
+// optionally filtered by chat_id, role, model and a from/to date range
+func (sc *SearchController) Search(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, err := parseSearchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hits, err := sc.searchService.Search(userID, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search"})
+		return
+	}
+	if hits == nil {
+		hits = []models.SearchHit{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": hits,
+		"pagination": gin.H{
+			"limit":  query.Limit,
+			"offset": query.Offset,
+			"count":  len(hits),
+		},
+	})
+}
+
+// SemanticSearch returns the authenticated user's messages closest in meaning
+// to ?q=, with the same filters as Search
+func (sc *SearchController) SemanticSearch(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, err := parseSearchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hits, err := sc.embeddingService.Search(c.Request.Context(), userID, query)
+	if err != nil {
+		var providerErr *services.ProviderError
+		switch {
+		case errors.Is(err, services.ErrSemanticSearchDisabled):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		case errors.As(err, &providerErr), errors.Is(err, services.ErrUpstreamTimeout):
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to embed query: " + err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search"})
+		}
+		return
+	}
+	if hits == nil {
+		hits = []models.SearchHit{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": hits,
+		"pagination": gin.H{
+			"limit":  query.Limit,
+			"offset": query.Offset,
+			"count":  len(hits),
+		},
+	})
+}
+
+func parseSearchQuery(c *gin.Context) (*models.SearchQuery, error) {
+	query := &models.SearchQuery{
+		Query: strings.TrimSpace(c.Query("q")),
+		Role:  c.Query("role"),
+		Model: c.Query("model"),
+	}
+	if query.Query == "" {
+		return nil, errors.New("Missing search query")
+	}
+
+	switch query.Role {
+	case "", "user", "assistant", "tool":
+	default:
+		return nil, errors.New("Invalid role, expected user, assistant or tool")
+	}
+
+	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if query.Limit <= 0 {
+		query.Limit = 20
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+	query.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	// Chat and date filters are shared with the usage endpoints.
+	filters, err := parseUsageQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	query.ChatID = filters.ChatID
+	query.From = filters.From
+	query.To = filters.To
+
+	return query, nil
+}
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kapi/models"
+	"kapi/services"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// generationWriter renders generation events onto an HTTP response. The plain
+// writer keeps the original text/plain format; the SSE writer emits typed
+// events for clients that opt in.
+type generationWriter interface {
+	start(info streamStart)
+	delta(event services.GenerationEvent)
+	reasoning(event services.GenerationEvent)
+	tool(event services.GenerationEvent)
+	formatRetry(event services.GenerationEvent)
+	retry(event services.GenerationEvent)
+	reset()
+	end(message *models.Message)
+	fail(err error, message *models.Message)
+}
+
+type streamStart struct {
+	ChatID             uint            `json:"chat_id"`
+	GenerationID       string          `json:"generation_id,omitempty"`
+	AssistantMessageID uint            `json:"assistant_message_id"`
+	Model              string          `json:"model,omitempty"`
+	Offset             int             `json:"offset"`
+	UserMessage        *models.Message `json:"user_message,omitempty"`
+}
+
+// wantsSSE reports whether the client asked for text/event-stream, either via
+// ?format=sse or the Accept header.
+func wantsSSE(c *gin.Context) bool {
+	if c.Query("format") == "sse" {
+		return true
+	}
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// streamOffset reads the resume position from ?offset= or, for SSE
+// reconnects, the Last-Event-ID header.
+func streamOffset(c *gin.Context) (int, error) {
+	raw := c.Query("offset")
+	if raw == "" {
+		raw = c.GetHeader("Last-Event-ID")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+
+	offset, err := strconv.Atoi(raw)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", raw)
+	}
+	return offset, nil
+}
+
+func newGenerationWriter(c *gin.Context, flusher http.Flusher) generationWriter {
+	if wantsSSE(c) {
+		setSSEHeaders(c)
+		return &sseWriter{c: c, flusher: flusher}
+	}
+
+	setStreamHeaders(c)
+	return &plainWriter{c: c, flusher: flusher}
+}
+
+func setSSEHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+}
+
+type plainWriter struct {
+	c       *gin.Context
+	flusher http.Flusher
+}
+
+func (w *plainWriter) start(info streamStart) {
+	w.c.Header("X-Generation-ID", info.GenerationID)
+	w.c.Header("X-Message-ID", strconv.FormatUint(uint64(info.AssistantMessageID), 10))
+	w.c.Header("X-Generation-Offset", strconv.Itoa(info.Offset))
+	w.c.Status(http.StatusOK)
+	w.flusher.Flush()
+}
+
+func (w *plainWriter) delta(event services.GenerationEvent) {
+	w.c.Writer.WriteString(event.Content)
+	w.flusher.Flush()
+}
+
+func (w *plainWriter) reasoning(event services.GenerationEvent) {}
+
+func (w *plainWriter) tool(event services.GenerationEvent) {}
+
+func (w *plainWriter) formatRetry(event services.GenerationEvent) {}
+
+func (w *plainWriter) retry(event services.GenerationEvent) {}
+
+func (w *plainWriter) reset() {}
+
+func (w *plainWriter) end(message *models.Message) {}
+
+func (w *plainWriter) fail(err error, message *models.Message) {
+	w.c.Writer.WriteString("\n\nError: " + err.Error())
+	w.flusher.Flush()
+}
+
+type sseWriter struct {
+	c       *gin.Context
+	flusher http.Flusher
+	// fields are added to every event, such as the reply index of a
+	// comparison. Such events carry no id, as offsets differ per reply.
+	fields gin.H
+}
+
+func (w *sseWriter) start(info streamStart) {
+	w.c.Status(http.StatusOK)
+	w.c.Writer.WriteString("retry: 2000\n\n")
+	w.write(strconv.Itoa(info.Offset), "message_start", info)
+}
+
+// delta events carry the byte offset reached after the chunk as their id, so
+// Last-Event-ID can be used directly as the resume offset.
+func (w *sseWriter) delta(event services.GenerationEvent) {
+	w.write(strconv.Itoa(event.Offset+len(event.Content)), "delta", gin.H{
+		"content": event.Content,
+		"offset":  event.Offset,
+	})
+}
+
+func (w *sseWriter) reasoning(event services.GenerationEvent) {
+	w.write("", "reasoning", gin.H{"content": event.Content})
+}
+
+// tool emits "tool_call" and "tool_result" events with the stored message.
+func (w *sseWriter) tool(event services.GenerationEvent) {
+	w.write("", event.Type, gin.H{"message": event.Message})
+}
+
+// formatRetry tells the client that the reply streamed so far is rejected.
+// A reset event follows.
+func (w *sseWriter) formatRetry(event services.GenerationEvent) {
+	w.write("", "format_retry", gin.H{"error": event.Content, "offset": event.Offset})
+}
+
+// retry emits "retry" and "fallback" events naming the model tried next and
+// the error that made the last attempt fail.
+func (w *sseWriter) retry(event services.GenerationEvent) {
+	w.write("", event.Type, gin.H{"model": event.Content, "error": event.Err.Error()})
+}
+
+// reset tells the client to drop the text received so far. Its id restarts
+// Last-Event-ID at zero, matching the offsets that follow.
+func (w *sseWriter) reset() {
+	w.write("0", "reset", gin.H{})
+}
+
+func (w *sseWriter) end(message *models.Message) {
+	if message == nil {
+		w.write("", "message_end", gin.H{"message": nil})
+		return
+	}
+
+	w.write("", "usage", gin.H{
+		"prompt_tokens":     message.PromptTokens,
+		"completion_tokens": message.CompletionTokens,
+		"reasoning_tokens":  message.ReasoningTokens,
+		"total_tokens":      message.TokensUsed,
+		"finish_reason":     message.FinishReason,
+	})
+	w.write("", "message_end", gin.H{"message": message})
+}
+
+// fail emits the error together with the stored failed reply, if any, which
+// keeps the partial content.
+func (w *sseWriter) fail(err error, message *models.Message) {
+	data := gin.H{"error": err.Error()}
+	if message != nil {
+		data["code"] = message.ErrorCode
+		data["message"] = message
+	}
+
+	var schemaErr *services.SchemaValidationError
+	if errors.As(err, &schemaErr) {
+		data["code"] = models.ErrorCodeResponseFormat
+		data["validation_errors"] = schemaErr.Errors
+		data["content"] = schemaErr.Content
+	}
+	w.write("", "error", data)
+}
+
+func (w *sseWriter) write(id, event string, data interface{}) {
+	if w.fields != nil {
+		id = ""
+		if values, ok := data.(gin.H); ok {
+			for key, value := range w.fields {
+				values[key] = value
+			}
+		}
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		payload, _ = json.Marshal(gin.H{"error": err.Error()})
+		event = "error"
+	}
+
+	if id != "" {
+		fmt.Fprintf(w.c.Writer, "id: %s\n", id)
+	}
+	fmt.Fprintf(w.c.Writer, "event: %s\ndata: %s\n\n", event, payload)
+	w.flusher.Flush()
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"errors"
+	"kapi/models"
+	"kapi/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type UsageController struct {
+	db           *gorm.DB
+	usageService *services.UsageService
+	quotaService *services.QuotaService
+	userService  *services.UserService
+}
+
+func NewUsageController(db *gorm.DB, usageService *services.UsageService, quotaService *services.QuotaService) *UsageController {
+	return &UsageController{
+		db:           db,
+		usageService: usageService,
+		quotaService: quotaService,
+		userService:  services.NewUserService(db),
+	}
+}
+
+// GetUsage returns the authenticated user's LLM usage grouped by day, model or chat
+func (uc *UsageController) GetUsage(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, err := parseUsageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	groups, totals, err := uc.usageService.Summarize(userID, query)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidGroupBy) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":     groups,
+		"totals":   totals,
+		"group_by": query.GroupBy,
+	})
+}
+
+// GetUsageRecords returns the raw usage ledger for the authenticated user
+func (uc *UsageController) GetUsageRecords(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, err := parseUsageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	records, err := uc.usageService.ListRecords(userID, query, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage records"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": records,
+		"pagination": gin.H{
+			"limit":  limit,
+			"offset": offset,
+			"count":  len(records),
+		},
+	})
+}
+
+// GetQuota returns the remaining quota for the authenticated user
+func (uc *UsageController) GetQuota(c *gin.Context) {
+	userID, exists := getUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	hasKey, err := uc.userService.HasOpenRouterKey(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
+		return
+	}
+
+	status, err := uc.quotaService.Check(userID, !hasKey)
+	setQuotaHeaders(c, status)
+
+	var quotaErr *services.QuotaExceededError
+	if err != nil && !errors.As(err, &quotaErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check usage quota"})
+		return
+	}
+
+	response := gin.H{"data": status}
+	if quotaErr != nil {
+		response["exceeded"] = gin.H{
+			"scope":    quotaErr.Scope,
+			"period":   quotaErr.Period,
+			"kind":     quotaErr.Kind,
+			"reset_at": quotaErr.ResetAt,
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func parseUsageQuery(c *gin.Context) (*models.UsageQuery, error) {
+	query := &models.UsageQuery{
+		GroupBy: c.DefaultQuery("group_by", "day"),
+		Model:   c.Query("model"),
+	}
+
+	if raw := c.Query("chat_id"); raw != "" {
+		chatID, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid chat ID")
+		}
+		id := uint(chatID)
+		query.ChatID = &id
+	}
+
+	if raw := c.Query("from"); raw != "" {
+		from, err := parseDate(raw)
+		if err != nil {
+			return nil, errors.New("Invalid from date, expected YYYY-MM-DD or RFC3339")
+		}
+		query.From = &from
+	}
+
+	if raw := c.Query("to"); raw != "" {
+		to, err := parseDate(raw)
+		if err != nil {
+			return nil, errors.New("Invalid to date, expected YYYY-MM-DD or RFC3339")
+		}
+		// A bare date includes the whole day.
+		if len(raw) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+		query.To = &to
+	}
+
+	return query, nil
+}
+
+func parseDate(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
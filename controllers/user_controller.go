@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -14,12 +15,14 @@ import (
 type UserController struct {
 	db          *gorm.DB
 	userService *services.UserService
+	providers   *services.ProviderRegistry
 }
 
-func NewUserController(db *gorm.DB) *UserController {
+func NewUserController(db *gorm.DB, providers *services.ProviderRegistry) *UserController {
 	return &UserController{
 		db:          db,
 		userService: services.NewUserService(db),
+		providers:   providers,
 	}
 }
 
@@ -111,6 +114,15 @@ func (uc *UserController) UpdateOpenRouterKey(c *gin.Context) {
 		return
 	}
 
+	if err := uc.providers.ValidateUserKey(c.Request.Context(), req.OpenRouterKey); err != nil {
+		if errors.Is(err, services.ErrInvalidAPIKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OpenRouter key"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to verify OpenRouter key"})
+		return
+	}
+
 	if err := uc.userService.UpdateOpenRouterKey(userID.(uint), req.OpenRouterKey); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update OpenRouter key"})
 		return
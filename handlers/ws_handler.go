@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"kapi/models"
@@ -22,12 +23,14 @@ var upgrader = websocket.Upgrader{
 }
 
 type WebSocketHandler struct {
-	hubService *services.HubService
+	hubService        *services.HubService
+	generationService *services.GenerationService
 }
 
-func NewWebSocketHandler(hubService *services.HubService) *WebSocketHandler {
+func NewWebSocketHandler(hubService *services.HubService, generationService *services.GenerationService) *WebSocketHandler {
 	return &WebSocketHandler{
-		hubService: hubService,
+		hubService:        hubService,
+		generationService: generationService,
 	}
 }
 
@@ -144,6 +147,9 @@ func (wh *WebSocketHandler) readPump(client *models.Client) {
 				return
 			}
 
+		case "cancel_generation":
+			wh.handleCancelGeneration(client, wsMessage)
+
 		// TODO: handle other message types
 		// case "chat_message":
 		//     // Handle chat messages
@@ -155,6 +161,46 @@ func (wh *WebSocketHandler) readPump(client *models.Client) {
 	}
 }
 
+// handleCancelGeneration stops a running generation on behalf of the client.
+// Expected payload: {"type": "cancel_generation", "data": {"chat_id": 42}}
+func (wh *WebSocketHandler) handleCancelGeneration(client *models.Client, wsMessage models.WSMessage) {
+	var payload struct {
+		ChatID uint `json:"chat_id"`
+	}
+	data, _ := json.Marshal(wsMessage.Data)
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ChatID == 0 {
+		wh.sendToClient(client, "error", map[string]string{"error": "cancel_generation requires a chat_id"})
+		return
+	}
+
+	userID, err := strconv.ParseUint(client.UserID, 10, 32)
+	if err != nil {
+		log.Printf("Invalid user ID '%s' on client %s: %v", client.UserID, client.ID, err)
+		return
+	}
+
+	if err := wh.generationService.Cancel(payload.ChatID, uint(userID)); err != nil {
+		wh.sendToClient(client, "error", map[string]interface{}{"error": err.Error(), "chat_id": payload.ChatID})
+		return
+	}
+
+	log.Printf("Client %s (user %s) cancelled generation for chat %d", client.ID, client.UserID, payload.ChatID)
+}
+
+func (wh *WebSocketHandler) sendToClient(client *models.Client, messageType string, data interface{}) {
+	messageBytes, err := json.Marshal(models.WSMessage{Type: messageType, Data: data})
+	if err != nil {
+		log.Printf("Error marshaling '%s' message for client %s: %v", messageType, client.ID, err)
+		return
+	}
+
+	select {
+	case client.Send <- messageBytes:
+	default:
+		log.Printf("Failed to send '%s' message to client %s", messageType, client.ID)
+	}
+}
+
 func (wh *WebSocketHandler) writePump(client *models.Client) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
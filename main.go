@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -52,7 +53,11 @@ func main() {
 	}
 
 	db := database.Connect()
-	db.AutoMigrate(&models.User{}, &models.Post{}, &models.Chat{}, &models.Message{})
+	db.AutoMigrate(&models.User{}, &models.Post{}, &models.Chat{}, &models.Message{}, &models.UsageRecord{}, &models.Persona{}, &models.ChatSummary{}, &models.Attachment{})
+
+	if err := services.BackfillMessageTree(db); err != nil {
+		log.Printf("Failed to link existing chat messages: %v", err)
+	}
 
 	cfg := config.Load()
 
@@ -63,13 +68,52 @@ func main() {
 	r.Use(middleware.ErrorHandler())
 
 	hubService := services.NewHubService()
+	providers := services.NewProviderRegistry(cfg)
+	prices := services.LoadPriceTable(cfg.ModelPricesFile)
+	usageService := services.NewUsageService(db, prices)
+	quotaService := services.NewQuotaService(db, cfg.Quota)
+	generationService := services.NewGenerationService(hubService, cfg.GenerationRetention)
+	contextSizes := services.NewContextSizes(cfg.Context.DefaultWindow)
+	catalog := services.NewModelCatalog(providers, prices, contextSizes, cfg.Catalog, cfg.OpenRouterKey, cfg.DefaultModel)
+	go func() {
+		if err := catalog.Refresh(context.Background()); err != nil {
+			log.Printf("Failed to load model catalog: %v", err)
+		}
+	}()
+
+	storage, err := services.NewStorage(cfg.Attachments)
+	if err != nil {
+		log.Fatal("Failed to set up attachment storage:", err)
+	}
+	attachmentService := services.NewAttachmentService(db, storage, catalog, cfg.Attachments.MaxBytes)
+	toolRegistry := services.NewToolRegistry(db, cfg.Tools)
+	searchService := services.NewSearchService(db, cfg.Search.Language)
+	if err := searchService.EnsureIndexes(); err != nil {
+		log.Printf("Failed to create search indexes: %v", err)
+	}
+	embeddingProvider, err := services.NewEmbeddingProvider(cfg.Embeddings, cfg.Upstream)
+	if err != nil {
+		log.Fatal("Failed to set up embeddings:", err)
+	}
+	embeddingService := services.NewEmbeddingService(db, embeddingProvider, cfg.Embeddings)
+	if embeddingService.Enabled() {
+		if err := embeddingService.EnsureSchema(); err != nil {
+			log.Fatal("Failed to set up message embeddings (is pgvector installed?):", err)
+		}
+		go embeddingService.Run(context.Background())
+	}
 
-	userController := controllers.NewUserController(db)
+	userController := controllers.NewUserController(db, providers)
 	authController := controllers.NewAuthController(db)
-	chatController := controllers.NewChatController(db, cfg, hubService)
-	wsHandler := handlers.NewWebSocketHandler(hubService)
-
-	routes.SetupRoutes(r, userController, authController, chatController, wsHandler)
+	chatController := controllers.NewChatController(db, cfg, hubService, providers, usageService, quotaService, generationService, contextSizes, catalog, attachmentService, toolRegistry)
+	usageController := controllers.NewUsageController(db, usageService, quotaService)
+	personaController := controllers.NewPersonaController(db)
+	modelController := controllers.NewModelController(catalog)
+	attachmentController := controllers.NewAttachmentController(attachmentService)
+	searchController := controllers.NewSearchController(searchService, embeddingService)
+	wsHandler := handlers.NewWebSocketHandler(hubService, generationService)
+
+	routes.SetupRoutes(r, userController, authController, chatController, usageController, personaController, modelController, attachmentController, searchController, wsHandler)
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
@@ -29,8 +29,8 @@ func CORS() gin.HandlerFunc {
 		}
 
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		c.Header("Access-Control-Expose-Headers", "Content-Length")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Last-Event-ID")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Retry-After, X-Quota-Daily-Tokens-Remaining, X-Quota-Monthly-Tokens-Remaining, X-Quota-Daily-Cost-Remaining, X-Quota-Monthly-Cost-Remaining, X-Generation-ID, X-Message-ID, X-Generation-Offset")
 		c.Header("Access-Control-Allow-Credentials", "true")
 
 		if c.Request.Method == "OPTIONS" {
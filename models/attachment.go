@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Attachment is an uploaded file. It belongs to the uploading user until it
+// is linked to a message.
+type Attachment struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	UserID      uint           `json:"user_id" gorm:"not null;index"`
+	MessageID   *uint          `json:"message_id,omitempty" gorm:"index"`
+	FileName    string         `json:"file_name" gorm:"not null"`
+	ContentType string         `json:"content_type" gorm:"not null"`
+	Size        int64          `json:"size"`
+	StorageKey  string         `json:"-" gorm:"not null"`
+	CreatedAt   time.Time      `json:"created_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
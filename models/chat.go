@@ -1,16 +1,24 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 type Chat struct {
-	ID        uint           `json:"id" gorm:"primaryKey"`
-	UserID    uint           `json:"user_id" gorm:"not null;index"`
-	Title     string         `json:"title" gorm:"not null"`
-	IsActive  bool           `json:"is_active" gorm:"default:true"`
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	UserID   uint   `json:"user_id" gorm:"not null;index"`
+	Title    string `json:"title" gorm:"not null"`
+	IsActive bool   `json:"is_active" gorm:"default:true"`
+	// MessageTree is set once the chat's messages are linked by parent id.
+	MessageTree bool         `json:"-" gorm:"default:false"`
+	Settings    ChatSettings `json:"settings" gorm:"embedded"`
+	PersonaID   *uint        `json:"persona_id,omitempty" gorm:"index"`
+	// AutoTitle is set while the title is derived from the first message and
+	// may still be replaced by a generated one.
+	AutoTitle bool           `json:"-" gorm:"default:false"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
@@ -19,48 +27,293 @@ type Chat struct {
 }
 
 type Message struct {
-	ID         uint           `json:"id" gorm:"primaryKey"`
-	ChatID     uint           `json:"chat_id" gorm:"not null;index"`
-	Role       string         `json:"role" gorm:"not null"` // "user" or "assistant"
-	Content    string         `json:"content" gorm:"type:text;not null"`
-	TokensUsed int            `json:"tokens_used" gorm:"default:0"`
-	Model      string         `json:"model"`
-	CreatedAt  time.Time      `json:"created_at"`
-	UpdatedAt  time.Time      `json:"updated_at"`
-	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
-	Chat       Chat           `json:"chat,omitempty" gorm:"foreignKey:ChatID"`
+	ID               uint   `json:"id" gorm:"primaryKey"`
+	ChatID           uint   `json:"chat_id" gorm:"not null;index"`
+	Role             string `json:"role" gorm:"not null"` // "user", "assistant" or "tool"
+	Content          string `json:"content" gorm:"type:text;not null"`
+	TokensUsed       int    `json:"tokens_used" gorm:"default:0"`
+	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
+	ReasoningTokens  int    `json:"reasoning_tokens" gorm:"default:0"`
+	FinishReason     string `json:"finish_reason,omitempty"`
+	GenerationID     string `json:"generation_id,omitempty"`
+	Status           string `json:"status" gorm:"default:complete"`
+	// Reasoning is the model's thinking for an assistant reply. It is never
+	// sent back to the model and is only returned with ?include_reasoning=true.
+	Reasoning string `json:"reasoning,omitempty" gorm:"type:text"`
+	// Error and ErrorCode explain why a reply with status "error" failed.
+	// Whatever was streamed before the failure is kept as its content.
+	Error     string `json:"error,omitempty" gorm:"type:text"`
+	ErrorCode string `json:"error_code,omitempty"`
+	// ToolCalls are the functions an assistant message asked to run; each
+	// result follows as a "tool" message answering ToolCallID.
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty" gorm:"type:text;serializer:json"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	ToolName   string     `json:"tool_name,omitempty"`
+	// ResponseFormat is the structured output the reply was asked for; it is
+	// reused when the reply is regenerated.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty" gorm:"type:text;serializer:json"`
+	// ParentID is the message this one follows in the conversation tree.
+	// Messages sharing a parent are alternatives of which one is active.
+	ParentID    *uint          `json:"parent_id,omitempty" gorm:"index"`
+	IsActive    bool           `json:"is_active" gorm:"default:true"`
+	Model       string         `json:"model"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+	Chat        Chat           `json:"chat,omitempty" gorm:"foreignKey:ChatID"`
+	Attachments []Attachment   `json:"attachments,omitempty" gorm:"foreignKey:MessageID"`
 }
 
+// ToolCall is a function call requested by the model. Arguments is the raw
+// JSON text produced by the model.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ResponseFormat asks for a JSON reply, in the shape of the OpenAI API:
+// {"type": "json_schema", "json_schema": {"name": "...", "schema": {...}}}.
+// "json_object" only requires the reply to be a JSON object.
+type ResponseFormat struct {
+	Type       string            `json:"type" binding:"required,oneof=json_object json_schema"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty" binding:"required_if=Type json_schema"`
+}
+
+type JSONSchemaFormat struct {
+	Name   string          `json:"name,omitempty" binding:"omitempty,max=64"`
+	Schema json.RawMessage `json:"schema" binding:"required"`
+	Strict bool            `json:"strict,omitempty"`
+}
+
+// ChatSummary condenses a chat's history from the root up to and including
+// UpToMessageID. Because every message has a single path to the root, a
+// summary can be reused by any branch that passes through that message.
+type ChatSummary struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	ChatID        uint      `json:"chat_id" gorm:"not null;index"`
+	UpToMessageID uint      `json:"up_to_message_id" gorm:"not null;index"`
+	Content       string    `json:"content" gorm:"type:text;not null"`
+	Tokens        int       `json:"tokens"`
+	Model         string    `json:"model"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const (
+	MessageStatusStreaming = "streaming"
+	MessageStatusComplete  = "complete"
+	MessageStatusStopped   = "stopped"
+	MessageStatusError     = "error"
+)
+
+// Error codes of failed replies.
+const (
+	ErrorCodeRateLimited     = "rate_limited"
+	ErrorCodeProvider        = "provider_error"
+	ErrorCodeNetwork         = "network_error"
+	ErrorCodeTimeout         = "timeout"
+	ErrorCodeResponseFormat  = "response_format_mismatch"
+	ErrorCodeModelNotAllowed = "model_not_allowed"
+	ErrorCodeInterrupted     = "interrupted"
+	ErrorCodeInternal        = "internal_error"
+)
+
+// ChatSettings are applied to every generation in a chat. Unset sampling
+// parameters are left to the provider's defaults.
+type ChatSettings struct {
+	SystemPrompt    string   `json:"system_prompt" gorm:"type:text"`
+	DefaultModel    string   `json:"default_model"`
+	Temperature     *float64 `json:"temperature"`
+	TopP            *float64 `json:"top_p"`
+	MaxTokens       *int     `json:"max_tokens"`
+	Stop            []string `json:"stop" gorm:"type:text;serializer:json"`
+	ReasoningEffort string   `json:"reasoning_effort"`
+	// ContextStrategy decides what happens to history that does not fit the
+	// model's context window: "truncate" drops the oldest messages,
+	// "summarize" replaces them with a rolling summary.
+	ContextStrategy string `json:"context_strategy"`
+	// FallbackModels are tried in order when the model fails with a provider
+	// error.
+	FallbackModels []string `json:"fallback_models" gorm:"type:text;serializer:json"`
+}
+
+const (
+	ChatSettingSystemPrompt    = "system_prompt"
+	ChatSettingDefaultModel    = "default_model"
+	ChatSettingTemperature     = "temperature"
+	ChatSettingTopP            = "top_p"
+	ChatSettingMaxTokens       = "max_tokens"
+	ChatSettingStop            = "stop"
+	ChatSettingReasoningEffort = "reasoning_effort"
+	ChatSettingContextStrategy = "context_strategy"
+	ChatSettingFallbackModels  = "fallback_models"
+)
+
+const (
+	ContextStrategyTruncate  = "truncate"
+	ContextStrategySummarize = "summarize"
+)
+
 type UpdateChatRequest struct {
 	Title    string `json:"title" binding:"omitempty,min=1,max=100"`
 	IsActive *bool  `json:"is_active"`
+	ChatSettingsRequest
+}
+
+// ChatSettingsRequest changes the ChatSettings fields that are present.
+type ChatSettingsRequest struct {
+	SystemPrompt    *string   `json:"system_prompt" binding:"omitempty,max=20000"`
+	DefaultModel    *string   `json:"default_model" binding:"omitempty,max=200"`
+	Temperature     *float64  `json:"temperature" binding:"omitempty,min=0,max=2"`
+	TopP            *float64  `json:"top_p" binding:"omitempty,gt=0,max=1"`
+	MaxTokens       *int      `json:"max_tokens" binding:"omitempty,min=1,max=1000000"`
+	Stop            *[]string `json:"stop" binding:"omitempty,max=4,dive,min=1,max=100"`
+	ReasoningEffort *string   `json:"reasoning_effort" binding:"omitempty,oneof=minimal low medium high"`
+	ContextStrategy *string   `json:"context_strategy" binding:"omitempty,oneof=truncate summarize"`
+	FallbackModels  *[]string `json:"fallback_models" binding:"omitempty,max=5,dive,min=1,max=200"`
+	// Reset lists settings to return to their defaults.
+	Reset []string `json:"reset" binding:"omitempty,dive,oneof=system_prompt default_model temperature top_p max_tokens stop reasoning_effort context_strategy fallback_models"`
+}
+
+// Apply copies the settings present in req and returns the columns that
+// changed.
+func (s *ChatSettings) Apply(req *ChatSettingsRequest) []string {
+	var columns []string
+	if req.SystemPrompt != nil {
+		s.SystemPrompt = *req.SystemPrompt
+		columns = append(columns, ChatSettingSystemPrompt)
+	}
+	if req.DefaultModel != nil {
+		s.DefaultModel = *req.DefaultModel
+		columns = append(columns, ChatSettingDefaultModel)
+	}
+	if req.Temperature != nil {
+		s.Temperature = req.Temperature
+		columns = append(columns, ChatSettingTemperature)
+	}
+	if req.TopP != nil {
+		s.TopP = req.TopP
+		columns = append(columns, ChatSettingTopP)
+	}
+	if req.MaxTokens != nil {
+		s.MaxTokens = req.MaxTokens
+		columns = append(columns, ChatSettingMaxTokens)
+	}
+	if req.Stop != nil {
+		s.Stop = *req.Stop
+		columns = append(columns, ChatSettingStop)
+	}
+	if req.ReasoningEffort != nil {
+		s.ReasoningEffort = *req.ReasoningEffort
+		columns = append(columns, ChatSettingReasoningEffort)
+	}
+	if req.ContextStrategy != nil {
+		s.ContextStrategy = *req.ContextStrategy
+		columns = append(columns, ChatSettingContextStrategy)
+	}
+	if req.FallbackModels != nil {
+		s.FallbackModels = *req.FallbackModels
+		columns = append(columns, ChatSettingFallbackModels)
+	}
+
+	for _, setting := range req.Reset {
+		switch setting {
+		case ChatSettingSystemPrompt:
+			s.SystemPrompt = ""
+		case ChatSettingDefaultModel:
+			s.DefaultModel = ""
+		case ChatSettingTemperature:
+			s.Temperature = nil
+		case ChatSettingTopP:
+			s.TopP = nil
+		case ChatSettingMaxTokens:
+			s.MaxTokens = nil
+		case ChatSettingStop:
+			s.Stop = nil
+		case ChatSettingReasoningEffort:
+			s.ReasoningEffort = ""
+		case ChatSettingContextStrategy:
+			s.ContextStrategy = ""
+		case ChatSettingFallbackModels:
+			s.FallbackModels = nil
+		}
+		columns = append(columns, setting)
+	}
+
+	return columns
 }
 
 type CreateMessageRequest struct {
+	Content       string `json:"content" binding:"required,min=1"`
+	Role          string `json:"role" binding:"required,oneof=user assistant"`
+	Model         string `json:"model"`
+	ClientID      string `json:"client_id,omitempty"`
+	AttachmentIDs []uint `json:"attachment_ids,omitempty" binding:"max=10"`
+	// ResponseFormat requests a reply validated against a JSON Schema.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// CompareRequest sends one user message to several models at once.
+type CompareRequest struct {
+	Content        string          `json:"content" binding:"required,min=1"`
+	Models         []string        `json:"models" binding:"required,min=2,max=4,dive,required"`
+	ClientID       string          `json:"client_id,omitempty"`
+	AttachmentIDs  []uint          `json:"attachment_ids,omitempty" binding:"max=10"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+type UpdateMessageRequest struct {
 	Content  string `json:"content" binding:"required,min=1"`
-	Role     string `json:"role" binding:"required,oneof=user assistant"`
-	Model    string `json:"model"`
+	Model    string `json:"model,omitempty"`
 	ClientID string `json:"client_id,omitempty"`
+	// ResponseFormat applies to the reply generated for an edited user
+	// message.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+type RegenerateMessageRequest struct {
+	Model    string `json:"model,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// ResponseFormat replaces the format of the regenerated reply.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
 }
 
 type CreateDirectMessageRequest struct {
 	Content  string `json:"content" binding:"required"`
 	Model    string `json:"model,omitempty"`
 	ClientID string `json:"client_id,omitempty"`
+	// PersonaID attaches a persona to the new chat; the user's default
+	// persona is used when omitted.
+	PersonaID     *uint  `json:"persona_id,omitempty"`
+	AttachmentIDs []uint `json:"attachment_ids,omitempty" binding:"max=10"`
 }
 
 type ChatResponse struct {
-	ID           uint      `json:"id"`
-	UserID       uint      `json:"user_id"`
-	Title        string    `json:"title"`
-	IsActive     bool      `json:"is_active"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	MessageCount int64     `json:"message_count"`
-	LastMessage  *Message  `json:"last_message,omitempty"`
+	ID           uint         `json:"id"`
+	UserID       uint         `json:"user_id"`
+	Title        string       `json:"title"`
+	IsActive     bool         `json:"is_active"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	MessageCount int64        `json:"message_count"`
+	LastMessage  *Message     `json:"last_message,omitempty"`
+	Settings     ChatSettings `json:"settings"`
+	PersonaID    *uint        `json:"persona_id,omitempty"`
 }
 
 type ChatWithMessagesResponse struct {
 	ChatResponse
 	Messages []Message `json:"messages"`
 }
+
+// MessageNode is a message together with the messages that follow it.
+type MessageNode struct {
+	Message
+	Children []*MessageNode `json:"children"`
+}
+
+type ChatTreeResponse struct {
+	ChatResponse
+	Tree []*MessageNode `json:"tree"`
+}
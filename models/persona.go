@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Persona is a reusable set of instructions and generation settings that a
+// user can attach to new chats.
+type Persona struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	UserID    uint           `json:"user_id" gorm:"not null;index"`
+	Name      string         `json:"name" gorm:"not null"`
+	Settings  ChatSettings   `json:"settings" gorm:"embedded"`
+	IsDefault bool           `json:"is_default" gorm:"default:false"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+type CreatePersonaRequest struct {
+	Name      string `json:"name" binding:"required,min=1,max=100"`
+	IsDefault bool   `json:"is_default"`
+	ChatSettingsRequest
+}
+
+type UpdatePersonaRequest struct {
+	Name      string `json:"name" binding:"omitempty,min=1,max=100"`
+	IsDefault *bool  `json:"is_default"`
+	ChatSettingsRequest
+}
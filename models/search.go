@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+const (
+	SearchHitChat    = "chat"
+	SearchHitMessage = "message"
+)
+
+// SearchQuery selects the chats and messages returned by a search. Role and
+// Model only match messages, so chat titles are left out when either is set.
+type SearchQuery struct {
+	Query  string
+	ChatID *uint
+	Role   string
+	Model  string
+	From   *time.Time
+	To     *time.Time
+	Limit  int
+	Offset int
+}
+
+// SearchHit is a chat whose title or a message whose content matched a
+// search. Snippet is HTML-escaped text with matches wrapped in <mark>.
+type SearchHit struct {
+	Type      string    `json:"type"`
+	ChatID    uint      `json:"chat_id"`
+	ChatTitle string    `json:"chat_title"`
+	MessageID *uint     `json:"message_id,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Snippet   string    `json:"snippet"`
+	Rank      float64   `json:"rank"`
+	CreatedAt time.Time `json:"created_at"`
+}
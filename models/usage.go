@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+const (
+	UsageStatusSuccess = "success"
+	UsageStatusError   = "error"
+)
+
+// Key sources record who paid for a call: the user's own OpenRouter key, the
+// operator's shared default key, or a provider configured by the operator.
+const (
+	KeySourceUser     = "user"
+	KeySourceShared   = "shared"
+	KeySourceProvider = "provider"
+)
+
+// UsageRecord is one entry in the usage ledger; a row is written for every
+// call made to an LLM provider, successful or not.
+type UsageRecord struct {
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	UserID           uint      `json:"user_id" gorm:"not null;index"`
+	ChatID           *uint     `json:"chat_id,omitempty" gorm:"index"`
+	MessageID        *uint     `json:"message_id,omitempty"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model" gorm:"index"`
+	KeySource        string    `json:"key_source" gorm:"index"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	ReasoningTokens  int       `json:"reasoning_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	Estimated        bool      `json:"estimated"`
+	Cost             float64   `json:"cost"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           string    `json:"status" gorm:"not null"`
+	Error            string    `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt        time.Time `json:"created_at" gorm:"index"`
+}
+
+type UsageSummary struct {
+	Key              string  `json:"key,omitempty"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+type UsageQuery struct {
+	GroupBy string
+	ChatID  *uint
+	Model   string
+	From    *time.Time
+	To      *time.Time
+}
+
+// QuotaStatus describes the remaining allowance for a user; nil fields mean
+// the corresponding limit is not configured.
+type QuotaStatus struct {
+	DailyTokensRemaining   *int64   `json:"daily_tokens_remaining,omitempty"`
+	MonthlyTokensRemaining *int64   `json:"monthly_tokens_remaining,omitempty"`
+	DailyCostRemaining     *float64 `json:"daily_cost_remaining,omitempty"`
+	MonthlyCostRemaining   *float64 `json:"monthly_cost_remaining,omitempty"`
+	Enforced               bool     `json:"enforced"`
+}
@@ -16,18 +16,20 @@ import (
 )
 
 type User struct {
-	ID            uint           `json:"id" gorm:"primaryKey"`
-	Email         string         `json:"email" gorm:"uniqueIndex;not null"`
-	Username      string         `json:"username" gorm:"uniqueIndex;not null"`
-	Password      string         `json:"-" gorm:"not null"`
-	FirstName     string         `json:"first_name"`
-	LastName      string         `json:"last_name"`
-	OpenRouterKey string         `json:"-" gorm:"column:openrouter_key"`
-	IsActive      bool           `json:"is_active" gorm:"default:true"`
-	CreatedAt     time.Time      `json:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at"`
-	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
-	Posts         []Post         `json:"posts,omitempty" gorm:"foreignKey:UserID"`
+	ID            uint   `json:"id" gorm:"primaryKey"`
+	Email         string `json:"email" gorm:"uniqueIndex;not null"`
+	Username      string `json:"username" gorm:"uniqueIndex;not null"`
+	Password      string `json:"-" gorm:"not null"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	OpenRouterKey string `json:"-" gorm:"column:openrouter_key"`
+	// CustomInstructions are prepended to the system prompt of every chat.
+	CustomInstructions string         `json:"custom_instructions" gorm:"type:text"`
+	IsActive           bool           `json:"is_active" gorm:"default:true"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt `json:"-" gorm:"index"`
+	Posts              []Post         `json:"posts,omitempty" gorm:"foreignKey:UserID"`
 }
 
 type CreateUserRequest struct {
@@ -44,9 +46,10 @@ type LoginRequest struct {
 }
 
 type UpdateUserRequest struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Username  string `json:"username"`
+	FirstName          string  `json:"first_name"`
+	LastName           string  `json:"last_name"`
+	Username           string  `json:"username"`
+	CustomInstructions *string `json:"custom_instructions" binding:"omitempty,max=20000"`
 }
 
 type UpdateOpenRouterKeyRequest struct {
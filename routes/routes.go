@@ -9,7 +9,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(r *gin.Engine, userController *controllers.UserController, authController *controllers.AuthController, chatController *controllers.ChatController, w *handlers.WebSocketHandler) {
+func SetupRoutes(r *gin.Engine, userController *controllers.UserController, authController *controllers.AuthController, chatController *controllers.ChatController, usageController *controllers.UsageController, personaController *controllers.PersonaController, modelController *controllers.ModelController, attachmentController *controllers.AttachmentController, searchController *controllers.SearchController, w *handlers.WebSocketHandler) {
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
@@ -51,6 +51,9 @@ func SetupRoutes(r *gin.Engine, userController *controllers.UserController, auth
 			chats.PUT("/:id", chatController.UpdateChat)
 			chats.DELETE("/:id", chatController.DeleteChat)
 			chats.POST("/:id/stream", chatController.CreateDirectMessageStream)
+			chats.POST("/:id/compare", chatController.CompareModels)
+			chats.GET("/:id/generation/stream", chatController.StreamGeneration)
+			chats.POST("/:id/generation/cancel", chatController.CancelGeneration)
 		}
 
 		messages := api.Group("/chats/:id/messages")
@@ -60,6 +63,40 @@ func SetupRoutes(r *gin.Engine, userController *controllers.UserController, auth
 			messages.GET("", chatController.GetChatMessages)
 			messages.PUT("/:messageId", chatController.UpdateMessage)
 			messages.DELETE("/:messageId", chatController.DeleteMessage)
+			messages.POST("/:messageId/regenerate", chatController.RegenerateMessage)
+			messages.GET("/:messageId/alternatives", chatController.ListAlternatives)
+			messages.PUT("/:messageId/active", chatController.SelectAlternative)
+		}
+
+		api.GET("/models", middleware.AuthRequired(), modelController.GetModels)
+		api.GET("/search", middleware.AuthRequired(), searchController.Search)
+		api.GET("/search/semantic", middleware.AuthRequired(), searchController.SemanticSearch)
+
+		personas := api.Group("/personas")
+		personas.Use(middleware.AuthRequired())
+		{
+			personas.GET("", personaController.GetPersonas)
+			personas.POST("", personaController.CreatePersona)
+			personas.GET("/:id", personaController.GetPersona)
+			personas.PUT("/:id", personaController.UpdatePersona)
+			personas.DELETE("/:id", personaController.DeletePersona)
+		}
+
+		attachments := api.Group("/attachments")
+		attachments.Use(middleware.AuthRequired())
+		{
+			attachments.POST("", attachmentController.UploadAttachment)
+			attachments.GET("/:id", attachmentController.GetAttachment)
+			attachments.GET("/:id/content", attachmentController.GetAttachmentContent)
+			attachments.DELETE("/:id", attachmentController.DeleteAttachment)
+		}
+
+		usage := api.Group("/usage")
+		usage.Use(middleware.AuthRequired())
+		{
+			usage.GET("", usageController.GetUsage)
+			usage.GET("/records", usageController.GetUsageRecords)
+			usage.GET("/quota", usageController.GetQuota)
 		}
 	}
 }
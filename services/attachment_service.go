@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kapi/models"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAttachmentTooLarge    = errors.New("attachment is too large")
+	ErrUnsupportedAttachment = errors.New("unsupported attachment type")
+)
+
+// attachmentTypes lists the accepted media types besides text/*.
+var attachmentTypes = map[string]bool{
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"application/pdf":  true,
+	"application/json": true,
+}
+
+type AttachmentService struct {
+	db       *gorm.DB
+	storage  Storage
+	catalog  *ModelCatalog
+	maxBytes int64
+}
+
+func NewAttachmentService(db *gorm.DB, storage Storage, catalog *ModelCatalog, maxBytes int64) *AttachmentService {
+	return &AttachmentService{db: db, storage: storage, catalog: catalog, maxBytes: maxBytes}
+}
+
+// MaxBytes is the largest accepted upload.
+func (s *AttachmentService) MaxBytes() int64 {
+	return s.maxBytes
+}
+
+// Upload stores a file for the user. It stays unlinked until it is sent with
+// a message.
+func (s *AttachmentService) Upload(ctx context.Context, userID uint, fileName, contentType string, data []byte) (*models.Attachment, error) {
+	if int64(len(data)) > s.maxBytes {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	contentType = normalizeContentType(contentType, data)
+	if attachmentKind(contentType) == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAttachment, contentType)
+	}
+
+	attachment := &models.Attachment{
+		UserID:      userID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		StorageKey:  fmt.Sprintf("%d/%s", userID, uuid.New().String()),
+	}
+
+	if err := s.storage.Put(ctx, attachment.StorageKey, data, contentType); err != nil {
+		return nil, fmt.Errorf("failed to store attachment: %v", err)
+	}
+
+	if err := s.db.Create(attachment).Error; err != nil {
+		s.storage.Delete(ctx, attachment.StorageKey)
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+func (s *AttachmentService) GetAttachment(attachmentID, userID uint) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := s.db.Where("id = ? AND user_id = ?", attachmentID, userID).
+		First(&attachment).Error; err != nil {
+		return nil, errors.New("attachment not found")
+	}
+	return &attachment, nil
+}
+
+// Open returns the attachment together with its contents. The caller closes
+// the reader.
+func (s *AttachmentService) Open(ctx context.Context, attachmentID, userID uint) (*models.Attachment, io.ReadCloser, error) {
+	attachment, err := s.GetAttachment(attachmentID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := s.storage.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachment, content, nil
+}
+
+// DeleteAttachment removes the attachment. The stored object is kept while
+// copies made for edited messages still refer to it.
+func (s *AttachmentService) DeleteAttachment(ctx context.Context, attachmentID, userID uint) error {
+	attachment, err := s.GetAttachment(attachmentID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Delete(attachment).Error; err != nil {
+		return err
+	}
+
+	s.deleteUnreferenced(ctx, attachment.StorageKey)
+	return nil
+}
+
+// DeleteForMessages removes the attachments of deleted messages, along with
+// the stored objects no other attachment refers to.
+func (s *AttachmentService) DeleteForMessages(ctx context.Context, messageIDs []uint) error {
+	var attachments []models.Attachment
+	if err := s.db.Where("message_id IN ?", messageIDs).Find(&attachments).Error; err != nil {
+		return err
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	if err := s.db.Delete(&attachments).Error; err != nil {
+		return err
+	}
+
+	keys := map[string]bool{}
+	for _, a := range attachments {
+		if !keys[a.StorageKey] {
+			keys[a.StorageKey] = true
+			s.deleteUnreferenced(ctx, a.StorageKey)
+		}
+	}
+	return nil
+}
+
+// deleteUnreferenced deletes the stored object once no attachment refers to
+// it.
+func (s *AttachmentService) deleteUnreferenced(ctx context.Context, key string) {
+	var remaining int64
+	s.db.Model(&models.Attachment{}).Where("storage_key = ?", key).Count(&remaining)
+	if remaining == 0 {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete stored attachment %s: %v", key, err)
+		}
+	}
+}
+
+// CheckUnlinked verifies that every id names an attachment of the user that
+// has not been sent with a message yet.
+func (s *AttachmentService) CheckUnlinked(userID uint, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var count int64
+	if err := s.db.Model(&models.Attachment{}).
+		Where("id IN ? AND user_id = ? AND message_id IS NULL", ids, userID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(uniqueIDs(ids)) {
+		return errors.New("attachment not found")
+	}
+	return nil
+}
+
+// Link attaches uploaded files to a message and returns them. Nothing is
+// linked if any of them is missing or already belongs to a message.
+func (s *AttachmentService) Link(userID, messageID uint, ids []uint) ([]models.Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var attachments []models.Attachment
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Attachment{}).
+			Where("id IN ? AND user_id = ? AND message_id IS NULL", ids, userID).
+			Update("message_id", messageID)
+		if result.Error != nil {
+			return result.Error
+		}
+		// Another request may have linked some of them since CheckUnlinked.
+		if int(result.RowsAffected) != len(uniqueIDs(ids)) {
+			return errors.New("attachment not found")
+		}
+
+		return tx.Where("message_id = ?", messageID).Order("id ASC").
+			Find(&attachments).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// CopyToMessage links copies of a message's attachments to another message,
+// sharing the stored objects.
+func (s *AttachmentService) CopyToMessage(fromMessageID, toMessageID uint) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+	if err := s.db.Where("message_id = ?", fromMessageID).Order("id ASC").
+		Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+
+	copies := make([]models.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		copies = append(copies, models.Attachment{
+			UserID:      a.UserID,
+			MessageID:   &toMessageID,
+			FileName:    a.FileName,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			StorageKey:  a.StorageKey,
+		})
+	}
+	if len(copies) == 0 {
+		return copies, nil
+	}
+	if err := s.db.Create(&copies).Error; err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+// uniqueIDs returns ids without duplicates.
+func uniqueIDs(ids []uint) map[uint]bool {
+	unique := map[uint]bool{}
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
+
+// CompletionMessage converts a stored message for the model. Text files are
+// inlined into the content; images and PDFs are sent as parts when the
+// model accepts them according to the catalog, and are otherwise replaced by
+// a note so the model knows something was attached.
+func (s *AttachmentService) CompletionMessage(ctx context.Context, model string, msg models.Message) CompletionMessage {
+	result := CompletionMessage{Role: msg.Role, Content: msg.Content}
+
+	for _, a := range msg.Attachments {
+		kind := attachmentKind(a.ContentType)
+		if kind != "text" && !s.catalog.SupportsInput(model, kind) {
+			result.Content += fmt.Sprintf("\n\n[Attachment %q (%s) was omitted: the model does not accept this type]", a.FileName, a.ContentType)
+			continue
+		}
+
+		data, err := s.read(ctx, a.StorageKey)
+		if err != nil {
+			log.Printf("Failed to read attachment %d: %v", a.ID, err)
+			result.Content += fmt.Sprintf("\n\n[Attachment %q could not be loaded]", a.FileName)
+			continue
+		}
+
+		if kind == "text" {
+			result.Content += fmt.Sprintf("\n\n--- %s ---\n%s", a.FileName, data)
+			continue
+		}
+		result.Parts = append(result.Parts, ContentPart{
+			Type:      kind,
+			MediaType: a.ContentType,
+			FileName:  a.FileName,
+			Data:      data,
+		})
+	}
+
+	return result
+}
+
+func (s *AttachmentService) read(ctx context.Context, key string) ([]byte, error) {
+	content, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// attachmentKind maps a media type to "image", "file" or "text", or returns
+// "" for types that are not accepted.
+func attachmentKind(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/") && attachmentTypes[contentType]:
+		return "image"
+	case contentType == "application/pdf":
+		return "file"
+	case strings.HasPrefix(contentType, "text/") || contentType == "application/json":
+		return "text"
+	default:
+		return ""
+	}
+}
+
+// normalizeContentType drops parameters from the declared type and sniffs the
+// data when the client did not declare one.
+func normalizeContentType(declared string, data []byte) string {
+	if declared == "" || declared == "application/octet-stream" {
+		declared = http.DetectContentType(data)
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(mediaType)
+}
@@ -0,0 +1,435 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+func calculatorTool() *Tool {
+	return &Tool{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, the constants pi and e, and the functions sqrt, abs, floor, ceil, round, ln, log10, sin, cos, tan.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expression": map[string]interface{}{
+					"type":        "string",
+					"description": "The expression to evaluate, e.g. \"(2 + 3) * 4 ^ 2\"",
+				},
+			},
+			"required": []string{"expression"},
+		},
+		Run: func(ctx context.Context, userID uint, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Expression string `json:"expression"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+
+			value, err := evaluateExpression(args.Expression)
+			if err != nil {
+				return "", err
+			}
+			return toolJSON(map[string]interface{}{"expression": args.Expression, "result": value})
+		},
+	}
+}
+
+func currentTimeTool() *Tool {
+	return &Tool{
+		Name:        "current_time",
+		Description: "Get the current date and time, optionally in an IANA time zone such as \"Europe/Amsterdam\".",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]interface{}{
+					"type":        "string",
+					"description": "IANA time zone name; defaults to UTC",
+				},
+			},
+		},
+		Run: func(ctx context.Context, userID uint, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Timezone string `json:"timezone"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+
+			location := time.UTC
+			if args.Timezone != "" {
+				loc, err := time.LoadLocation(args.Timezone)
+				if err != nil {
+					return "", fmt.Errorf("unknown time zone %q", args.Timezone)
+				}
+				location = loc
+			}
+
+			now := time.Now().In(location)
+			return toolJSON(map[string]interface{}{
+				"time":     now.Format(time.RFC3339),
+				"timezone": location.String(),
+				"weekday":  now.Weekday().String(),
+			})
+		},
+	}
+}
+
+// searchChatsTool searches the messages of the calling user's chats only.
+func searchChatsTool(db *gorm.DB) *Tool {
+	return &Tool{
+		Name:        "search_chats",
+		Description: "Search the user's earlier conversations for messages containing the query text.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "Text to look for",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of results (1-20, default 5)",
+				},
+			},
+			"required": []string{"query"},
+		},
+		Run: func(ctx context.Context, userID uint, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Query string `json:"query"`
+				Limit int    `json:"limit"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+			args.Query = strings.TrimSpace(args.Query)
+			if args.Query == "" {
+				return "", errors.New("query is required")
+			}
+			if args.Limit <= 0 {
+				args.Limit = 5
+			}
+			if args.Limit > 20 {
+				args.Limit = 20
+			}
+
+			var rows []struct {
+				ChatID    uint
+				Title     string
+				Role      string
+				Content   string
+				CreatedAt time.Time
+			}
+			pattern := "%" + escapeLike(args.Query) + "%"
+			if err := db.WithContext(ctx).Table("messages").
+				Select("messages.chat_id, chats.title, messages.role, messages.content, messages.created_at").
+				Joins("JOIN chats ON chats.id = messages.chat_id").
+				Where("chats.user_id = ? AND chats.deleted_at IS NULL AND messages.deleted_at IS NULL", userID).
+				Where("messages.role IN ?", []string{"user", "assistant"}).
+				Where("messages.content ILIKE ?", pattern).
+				Order("messages.created_at DESC").
+				Limit(args.Limit).
+				Scan(&rows).Error; err != nil {
+				return "", fmt.Errorf("search failed: %v", err)
+			}
+
+			results := make([]map[string]interface{}, 0, len(rows))
+			for _, row := range rows {
+				results = append(results, map[string]interface{}{
+					"chat_id":    row.ChatID,
+					"chat_title": row.Title,
+					"role":       row.Role,
+					"snippet":    snippet(row.Content, args.Query, 200),
+					"created_at": row.CreatedAt.Format(time.RFC3339),
+				})
+			}
+			return toolJSON(map[string]interface{}{"results": results})
+		},
+	}
+}
+
+func toolJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// snippet returns about width runes of text around the first case-insensitive
+// match of query.
+func snippet(text, query string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+
+	start := 0
+	if idx := indexFold(runes, []rune(query)); idx >= 0 {
+		start = idx - width/4
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + width
+	if end > len(runes) {
+		end = len(runes)
+		start = end - width
+	}
+
+	result := string(runes[start:end])
+	if start > 0 {
+		result = "..." + result
+	}
+	if end < len(runes) {
+		result += "..."
+	}
+	return result
+}
+
+// indexFold returns the rune index of the first case-insensitive match of
+// query in text, or -1. Runes are compared one by one, since lowercasing a
+// whole string can change its length.
+func indexFold(text, query []rune) int {
+	if len(query) == 0 {
+		return 0
+	}
+	for i := 0; i+len(query) <= len(text); i++ {
+		match := true
+		for j, r := range query {
+			if unicode.ToLower(text[i+j]) != unicode.ToLower(r) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// evaluateExpression parses and evaluates an arithmetic expression.
+func evaluateExpression(expression string) (float64, error) {
+	p := &exprParser{input: expression}
+	value, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return value, nil
+}
+
+var exprFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+	"ln":    math.Log,
+	"log10": math.Log10,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+}
+
+var exprConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// exprParser is a recursive descent parser over the grammar
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = ("+" | "-") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | name | name "(" expr ")" | "(" expr ")"
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseExpr() (float64, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *exprParser) parseTerm() (float64, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case op == '*':
+			left *= right
+		case right == 0:
+			return 0, errors.New("division by zero")
+		case op == '/':
+			left /= right
+		default:
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.parseUnary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *exprParser) parsePrimary() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		value, err := p.parseExpr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		// Scientific notation such as 1.5e3.
+		if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+			next := p.pos + 1
+			if next < len(p.input) && (p.input[next] == '+' || p.input[next] == '-') {
+				next++
+			}
+			if next < len(p.input) && p.input[next] >= '0' && p.input[next] <= '9' {
+				p.pos = next
+				for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+					p.pos++
+				}
+			}
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return value, nil
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		name := strings.ToLower(p.input[start:p.pos])
+
+		if fn, ok := exprFunctions[name]; ok {
+			if p.peek() != '(' {
+				return 0, fmt.Errorf("expected ( after %s", name)
+			}
+			p.pos++
+			arg, err := p.parseExpr()
+			if err != nil {
+				return 0, err
+			}
+			if p.peek() != ')' {
+				return 0, errors.New("missing closing parenthesis")
+			}
+			p.pos++
+			return fn(arg), nil
+		}
+		if value, ok := exprConstants[name]; ok {
+			return value, nil
+		}
+		return 0, fmt.Errorf("unknown name %q", name)
+	case c == 0:
+		return 0, errors.New("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
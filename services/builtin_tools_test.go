@@ -0,0 +1,43 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"kapi/models"
+)
+
+func TestSnippetHandlesRunesThatChangeLengthWhenLowercased(t *testing.T) {
+	// "Ⱥ" is two bytes, its lowercase form three.
+	text := strings.Repeat("Ⱥ", 300) + "zz"
+	got := snippet(text, "zz", 200)
+	if !strings.Contains(got, "zz") {
+		t.Fatalf("snippet %q does not contain the match", got)
+	}
+}
+
+func TestSnippetMatchesCaseInsensitively(t *testing.T) {
+	text := strings.Repeat("a", 300) + "Hello World" + strings.Repeat("b", 300)
+	got := snippet(text, "WORLD", 20)
+	if !strings.Contains(got, "World") || !strings.HasPrefix(got, "...") || !strings.HasSuffix(got, "...") {
+		t.Fatalf("unexpected snippet %q", got)
+	}
+}
+
+func TestExecuteRecoversFromPanickingTool(t *testing.T) {
+	registry := &ToolRegistry{tools: map[string]*Tool{
+		"broken": {
+			Name: "broken",
+			Run: func(ctx context.Context, userID uint, arguments json.RawMessage) (string, error) {
+				panic("boom")
+			},
+		},
+	}}
+
+	output := registry.Execute(context.Background(), 1, models.ToolCall{Name: "broken", Arguments: "{}"})
+	if !strings.HasPrefix(output, "Error:") {
+		t.Fatalf("expected an error result, got %q", output)
+	}
+}
@@ -1,67 +1,156 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
+	"kapi/config"
 	"kapi/models"
+	"log"
 	"net/http"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+var ErrNotAssistantMessage = errors.New("only assistant messages can be regenerated")
+
 type ChatService struct {
-	db            *gorm.DB
-	defaultKey    string
-	openRouterURL string
-	userService   *UserService
+	db             *gorm.DB
+	defaultKey     string
+	userService    *UserService
+	personaService *PersonaService
+	providers      *ProviderRegistry
+	usageService   *UsageService
+	quotaService   *QuotaService
+	generations    *GenerationService
+	contextBuilder *ContextBuilder
+	attachments    *AttachmentService
+	tools          *ToolRegistry
+	hubService     *HubService
+	titleModel     string
+	catalog        *ModelCatalog
+	// formatRetries is how often a reply not matching its response format
+	// is retried.
+	formatRetries int
+	retry         config.RetryConfig
 }
 
-func NewChatService(db *gorm.DB, defaultKey string, userService *UserService) *ChatService {
-	return &ChatService{
-		db:            db,
-		defaultKey:    defaultKey,
-		openRouterURL: "https://openrouter.ai/api/v1/chat/completions",
-		userService:   userService,
+func NewChatService(db *gorm.DB, defaultKey string, userService *UserService, personaService *PersonaService, providers *ProviderRegistry, usageService *UsageService, quotaService *QuotaService, generations *GenerationService, contextBuilder *ContextBuilder, attachments *AttachmentService, tools *ToolRegistry, hubService *HubService, titleModel string, catalog *ModelCatalog, formatRetries int, retry config.RetryConfig) *ChatService {
+	cs := &ChatService{
+		db:             db,
+		defaultKey:     defaultKey,
+		userService:    userService,
+		personaService: personaService,
+		providers:      providers,
+		usageService:   usageService,
+		quotaService:   quotaService,
+		generations:    generations,
+		contextBuilder: contextBuilder,
+		attachments:    attachments,
+		tools:          tools,
+		hubService:     hubService,
+		titleModel:     titleModel,
+		catalog:        catalog,
+		formatRetries:  formatRetries,
+		retry:          retry,
 	}
+	cs.failInterruptedGenerations()
+	return cs
 }
 
-func (cs *ChatService) generateChatTitle(content string) string {
-	if len(content) > 50 {
-		return content[:47] + "..."
+// failInterruptedGenerations marks replies that were still streaming when the
+// server stopped as failed. Their generations ran in memory and are gone.
+func (cs *ChatService) failInterruptedGenerations() {
+	result := cs.db.Model(&models.Message{}).
+		Where("status = ?", models.MessageStatusStreaming).
+		Updates(map[string]interface{}{
+			"status":        models.MessageStatusError,
+			"error":         "generation was interrupted by a server restart",
+			"error_code":    models.ErrorCodeInterrupted,
+			"finish_reason": "error",
+		})
+	if result.Error != nil {
+		log.Printf("Failed to mark interrupted generations: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Marked %d interrupted generations as failed", result.RowsAffected)
 	}
-	return content
 }
 
-type OpenRouterMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// titlePrompt asks for a short title for the first exchange of a chat.
+const titlePrompt = "Write a short title (at most six words) for the conversation below. " +
+	"Reply with the title only, without quotes or trailing punctuation."
+
+// maxTitleLength matches the limit enforced on titles set through UpdateChat.
+const maxTitleLength = 100
+
+// generateChatTitle is the placeholder title used until a generated one is
+// available, and the fallback when title generation is disabled or fails.
+func (cs *ChatService) generateChatTitle(content string) string {
+	return truncateRunes(strings.TrimSpace(content), 50)
 }
 
-type OpenRouterRequest struct {
-	Model    string              `json:"model"`
-	Messages []OpenRouterMessage `json:"messages"`
-	Stream   bool                `json:"stream"`
+// truncateRunes shortens s to at most limit runes, ending with "..." when cut.
+func truncateRunes(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit-3]) + "..."
 }
 
-type OpenRouterStreamResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index int `json:"index"`
-		Delta struct {
-			Role    string `json:"role,omitempty"`
-			Content string `json:"content,omitempty"`
-		} `json:"delta"`
-		FinishReason *string `json:"finish_reason"`
-	} `json:"choices"`
+// generateTitle replaces the placeholder title of a chat with one written by
+// the title model after its first exchange, and notifies the user's devices.
+func (cs *ChatService) generateTitle(chatID, userID uint, reply *models.Message) {
+	if cs.titleModel == "" || cs.titleModel == "none" || reply.ParentID == nil {
+		return
+	}
+
+	// Claim the chat so concurrent replies do not generate twice.
+	result := cs.db.Model(&models.Chat{}).
+		Where("id = ? AND auto_title = ?", chatID, true).
+		UpdateColumn("auto_title", false)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+
+	var prompt models.Message
+	if err := cs.db.Where("id = ?", *reply.ParentID).First(&prompt).Error; err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	text, err := cs.complete(ctx, userID, chatID, cs.titleModel, []CompletionMessage{
+		{Role: "system", Content: titlePrompt},
+		{Role: "user", Content: fmt.Sprintf("user: %s\n\nassistant: %s", prompt.Content, reply.Content)},
+	})
+	if err != nil {
+		log.Printf("Failed to generate title for chat %d: %v", chatID, err)
+		return
+	}
+
+	title := strings.TrimSpace(strings.SplitN(strings.TrimSpace(text), "\n", 2)[0])
+	title = strings.Trim(title, "\"'`*# ")
+	if title == "" {
+		return
+	}
+	title = truncateRunes(title, maxTitleLength)
+
+	var chat models.Chat
+	if err := cs.db.Where("id = ?", chatID).First(&chat).Error; err != nil {
+		return
+	}
+	if err := cs.db.Model(&chat).UpdateColumn("title", title).Error; err != nil {
+		log.Printf("Failed to save title for chat %d: %v", chatID, err)
+		return
+	}
+	chat.Title = title
+
+	cs.hubService.BroadcastToUser(userID, "chat_updated", chatResponse(&chat))
 }
 
 func (cs *ChatService) GetUserChats(userID uint, limit, offset int) ([]models.ChatResponse, error) {
@@ -83,14 +172,7 @@ func (cs *ChatService) GetUserChats(userID uint, limit, offset int) ([]models.Ch
 
 	var responses []models.ChatResponse
 	for _, chat := range chats {
-		response := models.ChatResponse{
-			ID:        chat.ID,
-			UserID:    chat.UserID,
-			Title:     chat.Title,
-			IsActive:  chat.IsActive,
-			CreatedAt: chat.CreatedAt,
-			UpdatedAt: chat.UpdatedAt,
-		}
+		response := chatResponse(&chat)
 
 		cs.db.Model(&models.Message{}).Where("chat_id = ?", chat.ID).Count(&response.MessageCount)
 
@@ -107,35 +189,71 @@ func (cs *ChatService) GetUserChats(userID uint, limit, offset int) ([]models.Ch
 	return responses, nil
 }
 
-func (cs *ChatService) GetChatByID(chatID, userID uint) (*models.ChatWithMessagesResponse, error) {
+// GetChatByID returns the chat with the messages of its active path, or of
+// the branch ending at leafID when it is non-zero.
+func (cs *ChatService) GetChatByID(chatID, userID, leafID uint) (*models.ChatWithMessagesResponse, error) {
 	var chat models.Chat
 	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
 		First(&chat).Error; err != nil {
 		return nil, err
 	}
 
-	var messages []models.Message
-	if err := cs.db.Where("chat_id = ?", chatID).
-		Order("created_at ASC").
-		Find(&messages).Error; err != nil {
+	messages, err := cs.loadMessages(chatID)
+	if err != nil {
 		return nil, err
 	}
 
+	path := activePath(messages)
+	if leafID != 0 {
+		path = pathTo(messages, leafID)
+		if len(path) == 0 {
+			return nil, errors.New("message not found")
+		}
+	}
+	if path == nil {
+		path = []models.Message{}
+	}
+
 	response := &models.ChatWithMessagesResponse{
-		ChatResponse: models.ChatResponse{
-			ID:        chat.ID,
-			UserID:    chat.UserID,
-			Title:     chat.Title,
-			IsActive:  chat.IsActive,
-			CreatedAt: chat.CreatedAt,
-			UpdatedAt: chat.UpdatedAt,
-		},
-		Messages: messages,
+		ChatResponse: chatResponse(&chat),
+		Messages:     path,
 	}
 
 	return response, nil
 }
 
+// GetChatTree returns the chat with every message arranged as a tree.
+func (cs *ChatService) GetChatTree(chatID, userID uint) (*models.ChatTreeResponse, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, err
+	}
+
+	messages, err := cs.loadMessages(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ChatTreeResponse{
+		ChatResponse: chatResponse(&chat),
+		Tree:         buildTree(messages),
+	}, nil
+}
+
+func chatResponse(chat *models.Chat) models.ChatResponse {
+	return models.ChatResponse{
+		ID:        chat.ID,
+		UserID:    chat.UserID,
+		Title:     chat.Title,
+		IsActive:  chat.IsActive,
+		CreatedAt: chat.CreatedAt,
+		UpdatedAt: chat.UpdatedAt,
+		Settings:  chat.Settings,
+		PersonaID: chat.PersonaID,
+	}
+}
+
 func (cs *ChatService) UpdateChat(chatID, userID uint, req *models.UpdateChatRequest) (*models.Chat, error) {
 	var chat models.Chat
 	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
@@ -146,17 +264,23 @@ func (cs *ChatService) UpdateChat(chatID, userID uint, req *models.UpdateChatReq
 	updates := map[string]interface{}{}
 	if req.Title != "" {
 		updates["title"] = req.Title
+		updates["auto_title"] = false
 	}
 	if req.IsActive != nil {
 		updates["is_active"] = *req.IsActive
 	}
-
 	if len(updates) > 0 {
 		if err := cs.db.Model(&chat).Updates(updates).Error; err != nil {
 			return nil, err
 		}
 	}
 
+	if columns := chat.Settings.Apply(&req.ChatSettingsRequest); len(columns) > 0 {
+		if err := cs.db.Model(&chat).Select(columns).Updates(&chat).Error; err != nil {
+			return nil, err
+		}
+	}
+
 	return &chat, nil
 }
 
@@ -175,16 +299,23 @@ func (cs *ChatService) DeleteChat(chatID, userID uint) error {
 	return nil
 }
 
-func (cs *ChatService) CreateChatWithMessage(userID uint, req *models.CreateMessageRequest, responseChan chan<- string, errorChan chan<- error, chatIDChan chan<- uint) {
+func (cs *ChatService) CreateChatWithMessage(ctx context.Context, userID uint, req *models.CreateMessageRequest, responseChan chan<- string, errorChan chan<- error, chatIDChan chan<- uint) {
 	defer close(responseChan)
 	defer close(errorChan)
 	defer close(chatIDChan)
 
 	title := cs.generateChatTitle(req.Content)
 	chat := &models.Chat{
-		UserID:   userID,
-		Title:    title,
-		IsActive: true,
+		UserID:      userID,
+		Title:       title,
+		IsActive:    true,
+		MessageTree: true,
+		AutoTitle:   true,
+	}
+
+	if err := cs.attachments.CheckUnlinked(userID, req.AttachmentIDs); err != nil {
+		errorChan <- err
+		return
 	}
 
 	if err := cs.db.Create(chat).Error; err != nil {
@@ -206,10 +337,45 @@ func (cs *ChatService) CreateChatWithMessage(userID uint, req *models.CreateMess
 		return
 	}
 
+	if _, err := cs.attachments.Link(userID, userMessage.ID, req.AttachmentIDs); err != nil {
+		cs.db.Delete(userMessage)
+		errorChan <- err
+		return
+	}
+
 	cs.db.Model(chat).Update("updated_at", userMessage.CreatedAt)
 
-	if req.Role == "user" {
-		cs.streamLLMResponse(chat.ID, userID, req.Model, responseChan, errorChan)
+	if req.Role != "user" {
+		return
+	}
+
+	gen, err := cs.StartGeneration(chat.ID, userID, GenerationOptions{Model: req.Model, ClientID: req.ClientID})
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, events, unsubscribe := gen.Subscribe(0)
+	defer unsubscribe()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case GenerationEventDelta:
+				responseChan <- event.Content
+			case GenerationEventError:
+				errorChan <- event.Err
+				return
+			case GenerationEventDone:
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -220,156 +386,782 @@ func (cs *ChatService) CreateMessage(chatID, userID uint, req *models.CreateMess
 		return nil, errors.New("chat not found or access denied")
 	}
 
+	if err := cs.attachments.CheckUnlinked(userID, req.AttachmentIDs); err != nil {
+		return nil, err
+	}
+
+	leaf, err := cs.activeLeaf(chatID)
+	if err != nil {
+		return nil, err
+	}
+
 	userMessage := &models.Message{
-		ChatID:  chatID,
-		Role:    req.Role,
-		Content: req.Content,
-		Model:   req.Model,
+		ChatID:   chatID,
+		Role:     req.Role,
+		Content:  req.Content,
+		Model:    req.Model,
+		IsActive: true,
+	}
+	if leaf != nil {
+		userMessage.ParentID = &leaf.ID
 	}
 
 	if err := cs.db.Create(userMessage).Error; err != nil {
 		return nil, err
 	}
+	if userMessage.Attachments, err = cs.attachments.Link(userID, userMessage.ID, req.AttachmentIDs); err != nil {
+		cs.db.Delete(userMessage)
+		return nil, err
+	}
+	cs.deactivateSiblings(userMessage)
 
 	cs.db.Model(&chat).Update("updated_at", userMessage.CreatedAt)
 
 	return userMessage, nil
 }
 
-func (cs *ChatService) streamLLMResponse(chatID, userID uint, model string, responseChan chan<- string, errorChan chan<- error) (*models.Message, error) {
+// progressFlushInterval controls how often partial output of a running
+// generation is written to its assistant message.
+const progressFlushInterval = time.Second
+
+// GenerationOptions controls how a reply is generated.
+type GenerationOptions struct {
+	Model    string
+	ClientID string
+	// ParentID is the message being answered. It defaults to the end of the
+	// chat's active path.
+	ParentID uint
+	// ResponseFormat requests a JSON reply that is validated before it is
+	// stored.
+	ResponseFormat *models.ResponseFormat
+}
+
+// StartGeneration launches a background job that streams the assistant reply
+// for the chat. The job is not tied to the caller's request; clients follow
+// it through Generation.Subscribe. The new reply becomes the active child of
+// the message it answers.
+func (cs *ChatService) StartGeneration(chatID, userID uint, opts GenerationOptions) (*Generation, error) {
+	gens, err := cs.startGenerations(chatID, userID, []string{opts.Model}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return gens[0], nil
+}
+
+// StartComparison answers the same message with several models at once. The
+// replies are stored as alternatives of one turn; the first model's reply is
+// active until the user selects another. opts.Model is ignored.
+func (cs *ChatService) StartComparison(chatID, userID uint, modelIDs []string, opts GenerationOptions) ([]*Generation, error) {
+	return cs.startGenerations(chatID, userID, modelIDs, opts)
+}
 
+// ValidateGeneration checks a generation request without starting it, so
+// that the message it answers is only saved when the generation can run. An
+// empty list of models stands for opts.Model.
+func (cs *ChatService) ValidateGeneration(chatID, userID uint, modelIDs []string, opts GenerationOptions) error {
 	var chat models.Chat
 	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
 		First(&chat).Error; err != nil {
-		err = errors.New("chat not found or access denied")
-		errorChan <- err
-		return nil, err
+		return errors.New("chat not found or access denied")
 	}
-
-	var messages []models.Message
-	if err := cs.db.Where("chat_id = ?", chatID).
-		Order("created_at ASC").
-		Find(&messages).Error; err != nil {
-		errorChan <- err
-		return nil, err
+	if cs.IsGenerating(chatID, userID) {
+		return ErrGenerationInProgress
 	}
 
-	var openRouterMessages []OpenRouterMessage
-	for _, msg := range messages {
-		openRouterMessages = append(openRouterMessages, OpenRouterMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		})
+	if len(modelIDs) == 0 {
+		modelIDs = []string{opts.Model}
 	}
+	settings := cs.resolveSettings(&chat)
+	if _, err := cs.resolveModels(userID, modelIDs, &settings); err != nil {
+		return err
+	}
+	return checkResponseFormat(opts.ResponseFormat)
+}
 
-	if model == "" {
-		model = "google/gemini-2.0-flash-lite-001"
+// resolveModels replaces empty model IDs with the chat's default and checks
+// that each model is allowed and within the user's quota.
+func (cs *ChatService) resolveModels(userID uint, modelIDs []string, settings *models.ChatSettings) ([]string, error) {
+	resolved := make([]string, len(modelIDs))
+	for i, model := range modelIDs {
+		model = cs.generationModel(model, settings)
+		if err := cs.catalog.Check(model); err != nil {
+			return nil, err
+		}
+		if _, err := cs.checkQuota(userID, model); err != nil {
+			return nil, err
+		}
+		resolved[i] = model
 	}
+	return resolved, nil
+}
 
-	openRouterReq := OpenRouterRequest{
-		Model:    model,
-		Messages: openRouterMessages,
-		Stream:   true,
+func (cs *ChatService) startGenerations(chatID, userID uint, modelIDs []string, opts GenerationOptions) ([]*Generation, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
 	}
 
-	jsonData, err := json.Marshal(openRouterReq)
+	settings := cs.resolveSettings(&chat)
+
+	resolved, err := cs.resolveModels(userID, modelIDs, &settings)
 	if err != nil {
-		errorChan <- err
 		return nil, err
 	}
+	if err := checkResponseFormat(opts.ResponseFormat); err != nil {
+		return nil, err
+	}
+
+	var parent *models.Message
+	if opts.ParentID != 0 {
+		parent = &models.Message{}
+		if err := cs.db.Where("id = ? AND chat_id = ?", opts.ParentID, chatID).
+			First(parent).Error; err != nil {
+			return nil, errors.New("message not found")
+		}
+	} else {
+		leaf, err := cs.activeLeaf(chatID)
+		if err != nil {
+			return nil, err
+		}
+		parent = leaf
+	}
 
-	req, err := http.NewRequest("POST", cs.openRouterURL, bytes.NewBuffer(jsonData))
+	gens, contexts, err := cs.generations.StartGroup(chatID, userID, resolved, opts.ClientID)
 	if err != nil {
-		errorChan <- err
 		return nil, err
 	}
 
-	key, err := cs.getOpenRouterKey(userID)
+	placeholders := make([]*models.Message, len(gens))
+	for i, gen := range gens {
+		placeholder := &models.Message{
+			ChatID:         chatID,
+			Role:           "assistant",
+			Model:          gen.Model,
+			Status:         models.MessageStatusStreaming,
+			IsActive:       true,
+			ResponseFormat: opts.ResponseFormat,
+		}
+		if parent != nil {
+			placeholder.ParentID = &parent.ID
+		}
+		if err := cs.db.Create(placeholder).Error; err != nil {
+			for _, created := range placeholders[:i] {
+				cs.discardPlaceholder(created)
+			}
+			for _, gen := range gens {
+				cs.generations.Finish(gen, nil, err)
+			}
+			return nil, err
+		}
+		gen.MessageID = placeholder.ID
+		cs.deactivateSiblings(placeholder)
+		placeholders[i] = placeholder
+	}
+
+	// Each placeholder took over as the active reply; hand it back to the
+	// first one.
+	if len(placeholders) > 1 {
+		for _, placeholder := range placeholders[1:] {
+			placeholder.IsActive = false
+		}
+		cs.db.Model(placeholders[0]).Update("is_active", true)
+		cs.deactivateSiblings(placeholders[0])
+	}
+
+	for i, gen := range gens {
+		cs.generations.Announce(gen)
+
+		// Each job gets its own copies, which saving the reply updates.
+		chat, settings := chat, settings
+		go func(gen *Generation, ctx context.Context, placeholder *models.Message) {
+			// A bug while generating fails this reply, not the server.
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Printf("Generation %s panicked: %v\n%s", gen.ID, recovered, debug.Stack())
+					message, err := cs.failAssistantMessage(&chat, placeholder, errors.New("generation failed unexpectedly"))
+					cs.generations.Finish(gen, message, err)
+				}
+			}()
+
+			message, err := cs.streamLLMResponse(ctx, gen, &chat, &settings, parent, placeholder)
+			cs.generations.Finish(gen, message, err)
+			if err == nil && message.Status == models.MessageStatusComplete {
+				cs.generateTitle(chat.ID, gen.UserID, message)
+			}
+		}(gen, contexts[i], placeholders[i])
+	}
+
+	return gens, nil
+}
+
+// RegenerateMessage produces a new alternative for an assistant reply. The
+// existing reply is kept and can be selected again with SelectAlternative.
+func (cs *ChatService) RegenerateMessage(messageID, chatID, userID uint, opts GenerationOptions) (*Generation, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
+
+	var message models.Message
+	if err := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
+		First(&message).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	if message.Role != "assistant" {
+		return nil, ErrNotAssistantMessage
+	}
+
+	// A reply that used tools is regenerated from its first tool call.
+	start, err := cs.turnStart(&message)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get OpenRouter key: %v", err)
+		return nil, err
+	}
+
+	if start.ParentID == nil {
+		return nil, errors.New("message has no prompt to answer")
+	}
+
+	if opts.Model == "" {
+		opts.Model = message.Model
 	}
+	if opts.ResponseFormat == nil {
+		opts.ResponseFormat = message.ResponseFormat
+	}
+	opts.ParentID = *start.ParentID
+
+	return cs.StartGeneration(chatID, userID, opts)
+}
 
-	fmt.Println("Sending request to OpenRouter with model: " + model)
-	fmt.Println("Sending request to OpenRouter with key: " + key)
-	fmt.Println("Sending request to OpenRouter with url: " + cs.openRouterURL)
+// ListAlternatives returns the message and its siblings, oldest first: the
+// alternative replies of a turn or the edited versions of a prompt. For a
+// reply that used tools, the alternatives are those of its first tool call.
+func (cs *ChatService) ListAlternatives(messageID, chatID, userID uint) ([]models.Message, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key)
-	req.Header.Set("HTTP-Referer", "http://localhost:8080") // Adjust as per your actual referer
-	req.Header.Set("X-Title", "Your App Name")
+	var message models.Message
+	if err := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
+		First(&message).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	start, err := cs.turnStart(&message)
 	if err != nil {
-		errorChan <- err
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		err = fmt.Errorf("OpenRouter API error (Status: %d): %s", resp.StatusCode, string(body))
-		errorChan <- err
+	query := cs.db.Where("chat_id = ?", chatID)
+	if start.ParentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *start.ParentID)
+	}
+
+	var alternatives []models.Message
+	if err := query.Order("created_at ASC").Find(&alternatives).Error; err != nil {
 		return nil, err
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	var fullResponse strings.Builder
+	return alternatives, nil
+}
+
+// SelectAlternative switches the chat to the branch containing the message.
+func (cs *ChatService) SelectAlternative(messageID, chatID, userID uint) (*models.Message, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
+
+	var message models.Message
+	if err := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
+		First(&message).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	if err := cs.activatePath(&message); err != nil {
+		return nil, err
+	}
 
-		if !strings.HasPrefix(line, "data: ") {
-			continue
+	return &message, nil
+}
+
+// resolveSettings combines the user's custom instructions, the chat's persona
+// and the chat's own settings into the settings used for a generation.
+func (cs *ChatService) resolveSettings(chat *models.Chat) models.ChatSettings {
+	var instructions string
+	var user models.User
+	if err := cs.db.Select("custom_instructions").Where("id = ?", chat.UserID).
+		First(&user).Error; err == nil {
+		instructions = user.CustomInstructions
+	}
+
+	var persona *models.Persona
+	if chat.PersonaID != nil {
+		p, err := cs.personaService.GetPersona(*chat.PersonaID, chat.UserID)
+		if err == nil {
+			persona = p
 		}
+	}
 
-		data := strings.TrimPrefix(line, "data: ")
+	return mergeSettings(instructions, persona, chat.Settings)
+}
 
-		if data == "[DONE]" {
-			break
+func (cs *ChatService) streamLLMResponse(ctx context.Context, gen *Generation, chat *models.Chat, settings *models.ChatSettings, parent *models.Message, assistantMessage *models.Message) (*models.Message, error) {
+	// Only the branch leading to the message being answered is sent.
+	var messages []models.Message
+	if parent != nil {
+		all, err := cs.loadMessages(chat.ID)
+		if err != nil {
+			return cs.failAssistantMessage(chat, assistantMessage, err)
 		}
+		messages = pathTo(all, parent.ID)
+	}
 
-		var streamResp OpenRouterStreamResponse
-		if err := json.Unmarshal([]byte(data), &streamResp); err != nil {
-			fmt.Printf("Error unmarshalling OpenRouter stream data: %v, data: %s\n", err, data)
+	completionMessages := cs.contextBuilder.Build(ctx, chat.ID, gen.Model, settings, messages,
+		func(ctx context.Context, model string, prompt []CompletionMessage) (string, error) {
+			return cs.complete(ctx, gen.UserID, chat.ID, model, prompt)
+		})
+
+	target, err := cs.resolveTarget(gen.UserID, gen.Model)
+	if err != nil {
+		return cs.failAssistantMessage(chat, assistantMessage, err)
+	}
+	fallbacks := cs.fallbackModels(gen.Model, settings)
+
+	format := assistantMessage.ResponseFormat
+	if format != nil {
+		completionMessages = append([]CompletionMessage{{Role: "system", Content: responseFormatPrompt(format)}}, completionMessages...)
+	}
+	retries := 0
+
+	log.Printf("Sending request to %s with model: %s", target.provider.Name(), target.modelID)
+
+	// Each round streams one model response. A response calling tools is
+	// stored together with the tool results, which are sent back to the model
+	// in the next round. The last allowed round offers no tools so that the
+	// model has to answer.
+	// The reply's token counts cover every call made for it: tool rounds,
+	// retries, fallbacks and format retries.
+	var usage TokenUsage
+	var result *CompletionResult
+	var content, reasoning string
+	for round := 0; ; round++ {
+		roundTools := cs.toolsFor(target.model)
+		prompt := completionMessages
+		if round >= cs.tools.MaxRounds() {
+			roundTools = nil
+		}
+		if len(roundTools) == 0 {
+			prompt = flattenToolMessages(completionMessages)
+		}
+
+		roundStart := len(gen.Content())
+		reasoningStart := len(gen.Reasoning())
+
+		// Failures before the first token are retried with backoff, then
+		// handed to the fallback models in order. Once output has been
+		// streamed the error stands.
+		for attempt := 0; ; attempt++ {
+			var nativeFormat *models.ResponseFormat
+			if format != nil && cs.catalog.SupportsResponseFormat(target.model) {
+				nativeFormat = format
+			}
+
+			lastFlush := time.Now()
+			startedAt := time.Now()
+			result, err = target.provider.StreamChat(ctx, target.key, &CompletionRequest{
+				Model:           target.modelID,
+				Messages:        prompt,
+				Temperature:     settings.Temperature,
+				TopP:            settings.TopP,
+				MaxTokens:       settings.MaxTokens,
+				Stop:            settings.Stop,
+				ReasoningEffort: settings.ReasoningEffort,
+				Tools:           roundTools,
+				ResponseFormat:  nativeFormat,
+			}, func(delta StreamDelta) {
+				gen.Append(delta.Content)
+				gen.AppendReasoning(delta.Reasoning)
+				if time.Since(lastFlush) >= progressFlushInterval {
+					lastFlush = time.Now()
+					cs.db.Model(assistantMessage).Updates(map[string]interface{}{
+						"content":   gen.Content()[roundStart:],
+						"reasoning": gen.Reasoning()[reasoningStart:],
+					})
+				}
+			})
+			call := LLMCall{
+				UserID:    gen.UserID,
+				ChatID:    chat.ID,
+				MessageID: assistantMessage.ID,
+				Provider:  target.provider.Name(),
+				Model:     target.model,
+				KeySource: target.keySource,
+				Latency:   time.Since(startedAt),
+				Err:       err,
+				Usage: billedUsage(result, err, prompt,
+					gen.Content()[roundStart:]+gen.Reasoning()[reasoningStart:]),
+			}
+			cs.usageService.Record(call)
+			usage.add(call.Usage)
+
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			if len(gen.Content()) > roundStart || len(gen.Reasoning()) > reasoningStart {
+				break
+			}
+
+			if isTransient(err) && attempt < cs.retry.MaxRetries {
+				gen.AppendRetry(GenerationEventRetry, target.model, err)
+				if sleepContext(ctx, cs.backoff(attempt)) != nil {
+					break
+				}
+				continue
+			}
+			if !isProviderFailure(err) {
+				break
+			}
+			next, rest := cs.nextFallback(gen.UserID, fallbacks)
+			if next == nil {
+				break
+			}
+			log.Printf("Model %s failed, falling back to %s: %v", target.model, next.model, err)
+			gen.AppendRetry(GenerationEventFallback, next.model, err)
+			target, fallbacks = next, rest
+			assistantMessage.Model = target.model
+			attempt = -1
+		}
+
+		if err != nil {
+			// Keep what was streamed, whether the user stopped the reply or
+			// the provider failed.
+			assistantMessage.Content = gen.Content()[roundStart:]
+			assistantMessage.Reasoning = gen.Reasoning()[reasoningStart:]
+			setUsage(assistantMessage, usage)
+			if ctx.Err() == nil {
+				return cs.failAssistantMessage(chat, assistantMessage, err)
+			}
+			assistantMessage.FinishReason = "cancelled"
+			assistantMessage.Status = models.MessageStatusStopped
+			return cs.saveAssistantMessage(chat, assistantMessage)
+		}
+
+		content = gen.Content()[roundStart:]
+		reasoning = gen.Reasoning()[reasoningStart:]
+		if len(result.ToolCalls) > 0 && len(roundTools) > 0 {
+			toolMessages, err := cs.runTools(ctx, gen, assistantMessage, content, reasoning, result)
+			if err != nil {
+				setUsage(assistantMessage, usage)
+				return cs.failAssistantMessage(chat, assistantMessage, err)
+			}
+			completionMessages = append(completionMessages, toolMessages...)
+			gen.Reset()
 			continue
 		}
 
-		if len(streamResp.Choices) > 0 && streamResp.Choices[0].Delta.Content != "" {
-			content := streamResp.Choices[0].Delta.Content
-			fullResponse.WriteString(content)
-			responseChan <- content
+		if format == nil {
+			break
 		}
+		valid, problems := validateResponse(content, format)
+		if problems == nil {
+			content = valid
+			break
+		}
+		if retries >= cs.formatRetries {
+			assistantMessage.Content = content
+			assistantMessage.Reasoning = reasoning
+			setUsage(assistantMessage, usage)
+			return cs.failAssistantMessage(chat, assistantMessage, &SchemaValidationError{Errors: problems, Content: content})
+		}
+		retries++
+		gen.AppendFormatRetry(strings.Join(problems, "; "))
+		gen.Reset()
+		completionMessages = append(completionMessages,
+			CompletionMessage{Role: "assistant", Content: content},
+			CompletionMessage{Role: "user", Content: "Your reply does not match the required format:\n- " +
+				strings.Join(problems, "\n- ") + "\nReply again with only the corrected JSON."},
+		)
 	}
 
-	if err := scanner.Err(); err != nil {
-		errorChan <- err
+	assistantMessage.Content = content
+	assistantMessage.Reasoning = reasoning
+	setUsage(assistantMessage, usage)
+	assistantMessage.FinishReason = result.FinishReason
+	assistantMessage.GenerationID = result.GenerationID
+	assistantMessage.Status = models.MessageStatusComplete
+
+	return cs.saveAssistantMessage(chat, assistantMessage)
+}
+
+// setUsage stores token counts on a message.
+func setUsage(message *models.Message, usage TokenUsage) {
+	message.TokensUsed = usage.TotalTokens
+	message.PromptTokens = usage.PromptTokens
+	message.CompletionTokens = usage.CompletionTokens
+	message.ReasoningTokens = usage.ReasoningTokens
+}
+
+// toolsFor returns the tools offered to a model, or nil if it cannot call
+// functions.
+func (cs *ChatService) toolsFor(model string) []ToolDefinition {
+	if cs.tools.MaxRounds() <= 0 || !cs.catalog.SupportsTools(model) {
+		return nil
+	}
+	return cs.tools.Definitions()
+}
+
+// runTools stores a tool round in front of the reply placeholder: the
+// assistant message calling the tools, then one tool message per result. The
+// placeholder moves below the last result so that the active path reads call,
+// results, reply. The round's tokens are counted on the reply, not on the call
+// message. It returns the round as messages for the next request.
+func (cs *ChatService) runTools(ctx context.Context, gen *Generation, placeholder *models.Message, content, reasoning string, result *CompletionResult) ([]CompletionMessage, error) {
+	calls := result.ToolCalls
+	for i := range calls {
+		if calls[i].ID == "" {
+			calls[i].ID = fmt.Sprintf("call_%d_%d", placeholder.ID, i)
+		}
+	}
+
+	callMessage := &models.Message{
+		ChatID:       placeholder.ChatID,
+		Role:         "assistant",
+		Content:      content,
+		Reasoning:    reasoning,
+		Model:        placeholder.Model,
+		ToolCalls:    calls,
+		FinishReason: result.FinishReason,
+		GenerationID: result.GenerationID,
+		Status:       models.MessageStatusComplete,
+		ParentID:     placeholder.ParentID,
+		IsActive:     true,
+	}
+	if err := cs.db.Create(callMessage).Error; err != nil {
 		return nil, err
 	}
+	// A reply that is not the active alternative, as in a comparison, keeps
+	// its tool round off the active path too.
+	if placeholder.IsActive {
+		cs.deactivateSiblings(callMessage)
+	} else {
+		cs.db.Model(callMessage).Update("is_active", false)
+	}
+	gen.AppendToolMessage(GenerationEventToolCall, callMessage)
+
+	messages := []CompletionMessage{{Role: "assistant", Content: content, ToolCalls: calls}}
+	parentID := callMessage.ID
+	for _, call := range calls {
+		output := cs.tools.Execute(ctx, gen.UserID, call)
+
+		previous := parentID
+		toolMessage := &models.Message{
+			ChatID:     placeholder.ChatID,
+			Role:       "tool",
+			Content:    output,
+			Model:      placeholder.Model,
+			ToolCallID: call.ID,
+			ToolName:   call.Name,
+			Status:     models.MessageStatusComplete,
+			ParentID:   &previous,
+			IsActive:   true,
+		}
+		if err := cs.db.Create(toolMessage).Error; err != nil {
+			return nil, err
+		}
+		gen.AppendToolMessage(GenerationEventToolResult, toolMessage)
 
-	assistantMessage := &models.Message{
-		ChatID:  chatID,
-		Role:    "assistant",
-		Content: fullResponse.String(),
-		Model:   model,
+		messages = append(messages, CompletionMessage{
+			Role:       "tool",
+			Content:    output,
+			ToolCallID: call.ID,
+			ToolName:   call.Name,
+		})
+		parentID = toolMessage.ID
 	}
 
-	if err := cs.db.Create(assistantMessage).Error; err != nil {
-		errorChan <- err
+	placeholder.ParentID = &parentID
+	placeholder.IsActive = true
+	if err := cs.db.Model(placeholder).Updates(map[string]interface{}{
+		"parent_id": parentID,
+		"is_active": true,
+	}).Error; err != nil {
 		return nil, err
 	}
 
-	if err := cs.db.Model(&chat).Update("updated_at", assistantMessage.CreatedAt).Error; err != nil {
-		fmt.Printf("Warning: Failed to update chat updated_at for chat %d: %v\n", chatID, err)
+	return messages, nil
+}
+
+// complete runs a background completion for the user, such as a summary, and
+// returns the full text. Usage is recorded against the chat.
+func (cs *ChatService) complete(ctx context.Context, userID, chatID uint, model string, messages []CompletionMessage) (string, error) {
+	target, err := cs.resolveTarget(userID, model)
+	if err != nil {
+		return "", err
+	}
+	// Background completions are skipped rather than run past a limit.
+	if err := cs.checkTargetQuota(userID, target); err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	startedAt := time.Now()
+	result, err := target.provider.StreamChat(ctx, target.key, &CompletionRequest{
+		Model:    target.modelID,
+		Messages: messages,
+	}, func(delta StreamDelta) {
+		text.WriteString(delta.Content)
+	})
+
+	call := LLMCall{
+		UserID:    userID,
+		ChatID:    chatID,
+		Provider:  target.provider.Name(),
+		Model:     model,
+		KeySource: target.keySource,
+		Latency:   time.Since(startedAt),
+		Err:       err,
+		Usage:     billedUsage(result, err, messages, text.String()),
 	}
+	cs.usageService.Record(call)
 
-	return assistantMessage, nil
+	if err != nil {
+		return "", err
+	}
+	return text.String(), nil
 }
 
-func (cs *ChatService) StreamLLMResponse(chatID, userID uint, model string, responseChan chan<- string, errorChan chan<- error) (*models.Message, error) {
-	defer close(responseChan)
-	defer close(errorChan)
-	return cs.streamLLMResponse(chatID, userID, model, responseChan, errorChan)
+// billedUsage returns the usage to record for a call. Providers report usage
+// only at the end of a stream, so a stream that was cancelled or broke off
+// is estimated from the prompt and the output received; otherwise stopping a
+// reply just before it ends would cost nothing. Requests the provider
+// rejected are not billed.
+func billedUsage(result *CompletionResult, err error, prompt []CompletionMessage, output string) TokenUsage {
+	if result != nil && result.Usage.TotalTokens > 0 {
+		return result.Usage
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return TokenUsage{}
+	}
+
+	usage := TokenUsage{
+		PromptTokens:     countTokens(prompt),
+		CompletionTokens: estimateTokens(output),
+		Estimated:        true,
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+func (cs *ChatService) saveAssistantMessage(chat *models.Chat, message *models.Message) (*models.Message, error) {
+	if err := cs.db.Save(message).Error; err != nil {
+		return nil, err
+	}
+
+	if err := cs.db.Model(chat).Update("updated_at", message.UpdatedAt).Error; err != nil {
+		log.Printf("Failed to update chat updated_at for chat %d: %v", chat.ID, err)
+	}
+
+	return message, nil
+}
+
+// failAssistantMessage stores a reply that could not be completed with its
+// error, keeping any content already set on it. It returns the stored message
+// together with err so that clients see both.
+func (cs *ChatService) failAssistantMessage(chat *models.Chat, message *models.Message, err error) (*models.Message, error) {
+	message.Status = models.MessageStatusError
+	message.Error = err.Error()
+	message.ErrorCode = errorCode(err)
+	message.FinishReason = "error"
+
+	saved, saveErr := cs.saveAssistantMessage(chat, message)
+	if saveErr != nil {
+		log.Printf("Failed to store failed reply %d: %v", message.ID, saveErr)
+		return nil, err
+	}
+	return saved, err
+}
+
+// errorCode classifies a generation failure for clients.
+func errorCode(err error) string {
+	var schemaErr *SchemaValidationError
+	var providerErr *ProviderError
+	switch {
+	case errors.As(err, &schemaErr):
+		return models.ErrorCodeResponseFormat
+	case errors.Is(err, ErrModelNotAllowed):
+		return models.ErrorCodeModelNotAllowed
+	case errors.Is(err, ErrUpstreamTimeout):
+		return models.ErrorCodeTimeout
+	case errors.As(err, &providerErr):
+		if providerErr.StatusCode == http.StatusTooManyRequests {
+			return models.ErrorCodeRateLimited
+		}
+		return models.ErrorCodeProvider
+	case isTransient(err):
+		return models.ErrorCodeNetwork
+	}
+	return models.ErrorCodeInternal
+}
+
+// discardPlaceholder removes the streaming placeholder of a failed generation
+// and reactivates the previous alternative.
+func (cs *ChatService) discardPlaceholder(message *models.Message) {
+	if err := cs.db.Unscoped().Delete(message).Error; err != nil {
+		log.Printf("Failed to remove placeholder message %d: %v", message.ID, err)
+		return
+	}
+	cs.activateLatestSibling(message)
+}
+
+// GetGeneration returns the running or recently finished generation for a
+// chat. When a comparison runs several, messageID selects the one writing
+// that reply; zero selects the first.
+func (cs *ChatService) GetGeneration(chatID, userID, messageID uint) (*Generation, bool) {
+	for _, gen := range cs.generations.List(chatID, userID) {
+		if messageID == 0 || gen.MessageID == messageID {
+			return gen, true
+		}
+	}
+	return nil, false
+}
+
+// IsGenerating reports whether a response is currently being generated.
+func (cs *ChatService) IsGenerating(chatID, userID uint) bool {
+	return cs.generations.IsRunning(chatID, userID)
+}
+
+// GetLatestAssistantMessage returns the most recent assistant reply of a chat.
+func (cs *ChatService) GetLatestAssistantMessage(chatID, userID uint) (*models.Message, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
+
+	var message models.Message
+	// Messages that only called tools are part of a reply, not a reply.
+	if err := cs.db.Where("chat_id = ? AND role = ? AND tool_calls IS NULL", chatID, "assistant").
+		Order("created_at DESC").
+		First(&message).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	return &message, nil
+}
+
+// CancelGeneration stops the in-flight response for a chat. The partial
+// answer is persisted as a stopped message by the generation job.
+func (cs *ChatService) CancelGeneration(chatID, userID uint) error {
+	return cs.generations.Cancel(chatID, userID)
 }
 
 func (cs *ChatService) GetChatMessages(chatID, userID uint, limit, offset int) ([]models.Message, error) {
@@ -397,6 +1189,23 @@ func (cs *ChatService) GetChatMessages(chatID, userID uint, limit, offset int) (
 	return messages, nil
 }
 
+func (cs *ChatService) GetMessage(messageID, chatID, userID uint) (*models.Message, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
+
+	var message models.Message
+	if err := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
+		First(&message).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	return &message, nil
+}
+
+// UpdateMessage changes the content of a message in place.
 func (cs *ChatService) UpdateMessage(messageID, chatID, userID uint, content string) (*models.Message, error) {
 	var chat models.Chat
 	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
@@ -418,6 +1227,49 @@ func (cs *ChatService) UpdateMessage(messageID, chatID, userID uint, content str
 	return &message, nil
 }
 
+// EditMessage forks the conversation at a user message: the new content is
+// stored as a sibling of the original, which keeps its replies on the old
+// branch, and the new branch becomes active.
+func (cs *ChatService) EditMessage(messageID, chatID, userID uint, content string) (*models.Message, error) {
+	var chat models.Chat
+	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
+		First(&chat).Error; err != nil {
+		return nil, errors.New("chat not found or access denied")
+	}
+
+	var original models.Message
+	if err := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
+		First(&original).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	edited := &models.Message{
+		ChatID:   chatID,
+		Role:     original.Role,
+		Content:  content,
+		Model:    original.Model,
+		ParentID: original.ParentID,
+		IsActive: true,
+	}
+	if err := cs.db.Create(edited).Error; err != nil {
+		return nil, err
+	}
+	cs.deactivateSiblings(edited)
+
+	// The edit replaces the text only; files sent with the original stay.
+	attachments, err := cs.attachments.CopyToMessage(original.ID, edited.ID)
+	if err != nil {
+		return nil, err
+	}
+	edited.Attachments = attachments
+
+	cs.db.Model(&chat).Update("updated_at", edited.CreatedAt)
+
+	return edited, nil
+}
+
+// DeleteMessage removes a message together with the branch that follows it
+// and the attachments of the removed messages.
 func (cs *ChatService) DeleteMessage(messageID, chatID, userID uint) error {
 	var chat models.Chat
 	if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).
@@ -425,26 +1277,63 @@ func (cs *ChatService) DeleteMessage(messageID, chatID, userID uint) error {
 		return errors.New("chat not found or access denied")
 	}
 
-	result := cs.db.Where("id = ? AND chat_id = ?", messageID, chatID).
-		Delete(&models.Message{})
-
-	if result.Error != nil {
-		return result.Error
+	messages, err := cs.loadMessages(chatID)
+	if err != nil {
+		return err
 	}
 
-	if result.RowsAffected == 0 {
+	var message *models.Message
+	for i := range messages {
+		if messages[i].ID == messageID {
+			message = &messages[i]
+			break
+		}
+	}
+	if message == nil {
 		return errors.New("message not found")
 	}
 
+	ids := append(descendantIDs(messages, messageID), messageID)
+	if err := cs.db.Where("chat_id = ? AND id IN ?", chatID, ids).
+		Delete(&models.Message{}).Error; err != nil {
+		return err
+	}
+	if err := cs.attachments.DeleteForMessages(context.Background(), ids); err != nil {
+		log.Printf("Failed to delete attachments of message %d: %v", messageID, err)
+	}
+
+	cs.activateLatestSibling(message)
 	return nil
 }
 
-func (cs *ChatService) CreateChatWithMessageSync(userID uint, req *models.CreateMessageRequest) (*models.ChatWithMessagesResponse, error) {
+// CreateChatWithMessageSync creates a chat holding a single message. The chat
+// uses the given persona, or the user's default persona when personaID is nil.
+func (cs *ChatService) CreateChatWithMessageSync(userID uint, req *models.CreateMessageRequest, personaID *uint) (*models.ChatWithMessagesResponse, error) {
+	var persona *models.Persona
+	var err error
+	if personaID != nil {
+		persona, err = cs.personaService.GetPersona(*personaID, userID)
+	} else {
+		persona, err = cs.personaService.GetDefaultPersona(userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs.attachments.CheckUnlinked(userID, req.AttachmentIDs); err != nil {
+		return nil, err
+	}
+
 	title := cs.generateChatTitle(req.Content)
 	chat := &models.Chat{
-		UserID:   userID,
-		Title:    title,
-		IsActive: true,
+		UserID:      userID,
+		Title:       title,
+		IsActive:    true,
+		MessageTree: true,
+		AutoTitle:   true,
+	}
+	if persona != nil {
+		chat.PersonaID = &persona.ID
 	}
 
 	if err := cs.db.Create(chat).Error; err != nil {
@@ -462,40 +1351,104 @@ func (cs *ChatService) CreateChatWithMessageSync(userID uint, req *models.Create
 		return nil, err
 	}
 
+	if userMessage.Attachments, err = cs.attachments.Link(userID, userMessage.ID, req.AttachmentIDs); err != nil {
+		cs.db.Delete(userMessage)
+		return nil, err
+	}
+
 	cs.db.Model(chat).Update("updated_at", userMessage.CreatedAt)
 
 	response := &models.ChatWithMessagesResponse{
-		ChatResponse: models.ChatResponse{
-			ID:           chat.ID,
-			UserID:       chat.UserID,
-			Title:        chat.Title,
-			IsActive:     chat.IsActive,
-			CreatedAt:    chat.CreatedAt,
-			UpdatedAt:    chat.UpdatedAt,
-			MessageCount: 1,
-			LastMessage:  userMessage,
-		},
-		Messages: []models.Message{*userMessage},
+		ChatResponse: chatResponse(chat),
+		Messages:     []models.Message{*userMessage},
 	}
+	response.MessageCount = 1
+	response.LastMessage = userMessage
 
 	return response, nil
 }
 
-func (cs *ChatService) getOpenRouterKey(userID uint) (string, error) {
+// RequiresOpenRouterKey reports whether generating with the given model needs
+// an OpenRouter key on the user's account.
+func (cs *ChatService) RequiresOpenRouterKey(model string) bool {
+	provider, _, err := cs.providers.Resolve(model)
+	if err != nil {
+		return true
+	}
+	return provider.RequiresUserKey()
+}
+
+// generationModel returns the model a generation asking for model runs on:
+// model itself, else the chat's default, else the server's.
+func (cs *ChatService) generationModel(model string, settings *models.ChatSettings) string {
+	if model == "" && settings != nil {
+		model = settings.DefaultModel
+	}
+	if model == "" {
+		model = cs.catalog.DefaultModel()
+	}
+	return model
+}
+
+// CheckQuota enforces the spending limits for a generation in the chat with
+// the given model, or with the chat's default model when model is empty. A
+// chatID of 0 stands for a new chat. It returns the allowance left.
+func (cs *ChatService) CheckQuota(chatID, userID uint, model string) (*models.QuotaStatus, error) {
+	var settings *models.ChatSettings
+	if model == "" && chatID != 0 {
+		var chat models.Chat
+		if err := cs.db.Where("id = ? AND user_id = ?", chatID, userID).First(&chat).Error; err == nil {
+			resolved := cs.resolveSettings(&chat)
+			settings = &resolved
+		}
+	}
+	return cs.checkQuota(userID, cs.generationModel(model, settings))
+}
+
+// checkQuota enforces the spending limits for a call to model, which must
+// already be resolved to a concrete model.
+func (cs *ChatService) checkQuota(userID uint, model string) (*models.QuotaStatus, error) {
+	sharedKey, err := cs.UsesSharedKey(userID, model)
+	if err != nil {
+		return nil, err
+	}
+	return cs.quotaService.Check(userID, sharedKey)
+}
+
+// checkTargetQuota is checkQuota for a model whose key is already chosen.
+func (cs *ChatService) checkTargetQuota(userID uint, target *modelTarget) error {
+	_, err := cs.quotaService.Check(userID, target.keySource == models.KeySourceShared)
+	return err
+}
+
+// UsesSharedKey reports whether a generation with the given model would be
+// billed to the server's default OpenRouter key.
+func (cs *ChatService) UsesSharedKey(userID uint, model string) (bool, error) {
+	if !cs.RequiresOpenRouterKey(model) {
+		return false, nil
+	}
+	hasKey, err := cs.userService.HasOpenRouterKey(userID)
+	if err != nil {
+		return false, err
+	}
+	return !hasKey, nil
+}
+
+func (cs *ChatService) getOpenRouterKey(userID uint) (string, string, error) {
 	userKey, err := cs.userService.GetUserOpenRouterKey(userID)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// If user has their own key, use it
 	if userKey != "" {
-		return userKey, nil
+		return userKey, models.KeySourceUser, nil
 	}
 
 	// Fall back to default key if available
 	if cs.defaultKey != "" {
-		return cs.defaultKey, nil
+		return cs.defaultKey, models.KeySourceShared, nil
 	}
 
-	return "", fmt.Errorf("no OpenRouter key available")
+	return "", "", fmt.Errorf("no OpenRouter key available")
 }
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBilledUsageEstimatesCancelledStreams(t *testing.T) {
+	prompt := []CompletionMessage{{Role: "user", Content: "Tell me a long story about a lighthouse keeper."}}
+
+	usage := billedUsage(nil, context.Canceled, prompt, "Once upon a time, on a rocky coast, there was a lighthouse")
+	if !usage.Estimated || usage.PromptTokens == 0 || usage.CompletionTokens == 0 {
+		t.Fatalf("expected an estimate for a cancelled stream, got %+v", usage)
+	}
+	if usage.TotalTokens != usage.PromptTokens+usage.CompletionTokens {
+		t.Fatalf("total %d does not add up", usage.TotalTokens)
+	}
+
+	reported := &CompletionResult{Usage: TokenUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}}
+	if got := billedUsage(reported, nil, prompt, "ignored"); got != reported.Usage {
+		t.Fatalf("reported usage should be kept, got %+v", got)
+	}
+
+	rejected := &ProviderError{Provider: "openrouter", StatusCode: 400}
+	if got := billedUsage(nil, rejected, prompt, ""); got.TotalTokens != 0 {
+		t.Fatalf("rejected requests should not be billed, got %+v", got)
+	}
+}
+
+func TestUsageAddsUpRounds(t *testing.T) {
+	var usage TokenUsage
+	usage.add(TokenUsage{PromptTokens: 10, CompletionTokens: 4, TotalTokens: 14, Cost: 0.1})
+	usage.add(TokenUsage{PromptTokens: 20, CompletionTokens: 6, ReasoningTokens: 2, TotalTokens: 26, Estimated: true})
+
+	want := TokenUsage{PromptTokens: 30, CompletionTokens: 10, ReasoningTokens: 2, TotalTokens: 40, Cost: 0.1, Estimated: true}
+	if usage != want {
+		t.Fatalf("got %+v, want %+v", usage, want)
+	}
+}
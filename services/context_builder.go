@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"kapi/config"
+	"kapi/models"
+	"log"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// messageOverhead approximates the tokens a message costs for its role and
+// formatting on top of its content.
+const messageOverhead = 4
+
+// attachmentTokens is a rough cost of an image or PDF sent to the model.
+const attachmentTokens = 1000
+
+const summaryPrompt = "Summarize the conversation below for your own later reference. " +
+	"Keep facts, decisions, names, numbers and open questions; drop pleasantries. " +
+	"If a previous summary is given, merge it with the new messages. Reply with the summary only."
+
+// ContextSizes maps model ids to their context window in tokens.
+type ContextSizes struct {
+	mu       sync.RWMutex
+	sizes    map[string]int
+	fallback int
+}
+
+var defaultContextSizes = map[string]int{
+	"google/gemini-2.0-flash-lite-001":  1048576,
+	"google/gemini-2.0-flash-001":       1048576,
+	"openai/gpt-4o":                     128000,
+	"openai/gpt-4o-mini":                128000,
+	"anthropic/claude-3.5-sonnet":       200000,
+	"anthropic/claude-3.5-haiku":        200000,
+	"meta-llama/llama-3.3-70b-instruct": 131072,
+	"deepseek/deepseek-chat":            64000,
+}
+
+// NewContextSizes starts from the built-in sizes; fallback is assumed for
+// unknown models.
+func NewContextSizes(fallback int) *ContextSizes {
+	table := &ContextSizes{sizes: map[string]int{}, fallback: fallback}
+	table.Set(defaultContextSizes)
+	return table
+}
+
+func (t *ContextSizes) Set(sizes map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for model, size := range sizes {
+		if size > 0 {
+			t.sizes[model] = size
+		}
+	}
+}
+
+// Lookup accepts model ids with or without a provider prefix.
+func (t *ContextSizes) Lookup(model string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if size, ok := t.sizes[model]; ok {
+		return size
+	}
+	if idx := strings.Index(model, ":"); idx > 0 {
+		if size, ok := t.sizes[model[idx+1:]]; ok {
+			return size
+		}
+	}
+	return t.fallback
+}
+
+// completeFunc runs a non-streaming completion and returns its text.
+type completeFunc func(ctx context.Context, model string, messages []CompletionMessage) (string, error)
+
+// ContextBuilder assembles the prompt for a generation so that it fits the
+// model's context window. The system prompt and the newest messages are always
+// kept; older messages are dropped or summarized depending on the chat's
+// context strategy.
+type ContextBuilder struct {
+	db          *gorm.DB
+	sizes       *ContextSizes
+	attachments *AttachmentService
+	cfg         config.ContextConfig
+}
+
+func NewContextBuilder(db *gorm.DB, sizes *ContextSizes, attachments *AttachmentService, cfg config.ContextConfig) *ContextBuilder {
+	return &ContextBuilder{db: db, sizes: sizes, attachments: attachments, cfg: cfg}
+}
+
+// Build returns the messages to send for history, which must be ordered from
+// the root of the conversation to the message being answered. Failed replies
+// are left out.
+func (b *ContextBuilder) Build(ctx context.Context, chatID uint, model string, settings *models.ChatSettings, history []models.Message, complete completeFunc) []CompletionMessage {
+	history = withoutFailedReplies(history)
+
+	var system []CompletionMessage
+	if settings.SystemPrompt != "" {
+		system = append(system, CompletionMessage{Role: "system", Content: settings.SystemPrompt})
+	}
+
+	budget := b.budget(model, settings) - countTokens(system)
+
+	tail := fitTail(history, budget)
+	if len(tail) == len(history) {
+		return append(system, b.toCompletionMessages(ctx, model, history)...)
+	}
+
+	strategy := settings.ContextStrategy
+	if strategy == "" {
+		strategy = b.cfg.Strategy
+	}
+	if strategy != models.ContextStrategySummarize {
+		return append(system, b.toCompletionMessages(ctx, model, dropOrphanedToolResults(tail))...)
+	}
+
+	// Leave a quarter of the budget for the summary of the dropped messages.
+	tail = dropOrphanedToolResults(fitTail(history, budget-budget/4))
+	head := history[:len(history)-len(tail)]
+
+	summary, err := b.summarize(ctx, chatID, model, head, budget, complete)
+	if err != nil {
+		log.Printf("Failed to summarize chat %d, truncating instead: %v", chatID, err)
+		return append(system, b.toCompletionMessages(ctx, model, dropOrphanedToolResults(fitTail(history, budget)))...)
+	}
+
+	messages := append(system, CompletionMessage{
+		Role:    "system",
+		Content: "Summary of the earlier conversation:\n" + summary,
+	})
+	return append(messages, b.toCompletionMessages(ctx, model, tail)...)
+}
+
+// budget is the number of prompt tokens available for the model.
+func (b *ContextBuilder) budget(model string, settings *models.ChatSettings) int {
+	window := b.sizes.Lookup(model)
+	reserve := b.cfg.ReserveTokens
+	if settings.MaxTokens != nil {
+		reserve = *settings.MaxTokens
+	}
+	if reserve >= window {
+		return window / 2
+	}
+	return window - reserve
+}
+
+// summarize returns a summary of head, reusing the most recent stored summary
+// on this branch and extending it with the messages that follow it.
+func (b *ContextBuilder) summarize(ctx context.Context, chatID uint, model string, head []models.Message, budget int, complete completeFunc) (string, error) {
+	ids := make([]uint, len(head))
+	position := make(map[uint]int, len(head))
+	for i, msg := range head {
+		ids[i] = msg.ID
+		position[msg.ID] = i
+	}
+
+	var stored []models.ChatSummary
+	if err := b.db.Where("chat_id = ? AND up_to_message_id IN ?", chatID, ids).
+		Find(&stored).Error; err != nil {
+		return "", err
+	}
+
+	summary := ""
+	start := 0
+	for _, s := range stored {
+		if pos := position[s.UpToMessageID]; pos+1 > start {
+			summary = s.Content
+			start = pos + 1
+		}
+	}
+	if start == len(head) {
+		return summary, nil
+	}
+
+	summaryModel := b.cfg.SummaryModel
+	if summaryModel == "" {
+		summaryModel = model
+	}
+
+	// Summarize in chunks that fit the budget so that long histories do not
+	// overflow the summarizer's own context.
+	pending := head[start:]
+	for len(pending) > 0 {
+		chunk := fitHead(pending, budget-estimateTokens(summary)-estimateTokens(summaryPrompt))
+		if len(chunk) == 0 {
+			chunk = pending[:1]
+		}
+
+		var transcript strings.Builder
+		if summary != "" {
+			transcript.WriteString("Previous summary:\n" + summary + "\n\n")
+		}
+		transcript.WriteString("New messages:\n")
+		for _, msg := range chunk {
+			fmt.Fprintf(&transcript, "%s: %s\n\n", msg.Role, msg.Content)
+		}
+
+		text, err := complete(ctx, summaryModel, []CompletionMessage{
+			{Role: "system", Content: summaryPrompt},
+			{Role: "user", Content: transcript.String()},
+		})
+		if err != nil {
+			return "", err
+		}
+		summary = strings.TrimSpace(text)
+
+		record := &models.ChatSummary{
+			ChatID:        chatID,
+			UpToMessageID: chunk[len(chunk)-1].ID,
+			Content:       summary,
+			Tokens:        estimateTokens(summary),
+			Model:         summaryModel,
+		}
+		if err := b.db.Create(record).Error; err != nil {
+			log.Printf("Failed to store summary for chat %d: %v", chatID, err)
+		}
+
+		pending = pending[len(chunk):]
+	}
+
+	return summary, nil
+}
+
+// fitTail returns the longest suffix of messages within budget. The last
+// message is always included.
+func fitTail(messages []models.Message, budget int) []models.Message {
+	used := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		used += messageTokens(messages[i])
+		if used > budget && i < len(messages)-1 {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
+
+// dropOrphanedToolResults removes tool results at the start of a truncated
+// history whose tool call was cut off; providers reject them.
+func dropOrphanedToolResults(messages []models.Message) []models.Message {
+	for len(messages) > 1 && messages[0].Role == "tool" {
+		messages = messages[1:]
+	}
+	return messages
+}
+
+// withoutFailedReplies drops replies that ended with an error; their partial
+// text would mislead the model.
+func withoutFailedReplies(messages []models.Message) []models.Message {
+	kept := make([]models.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Status != models.MessageStatusError {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// fitHead returns the longest prefix of messages within budget.
+func fitHead(messages []models.Message, budget int) []models.Message {
+	used := 0
+	for i, msg := range messages {
+		used += messageTokens(msg)
+		if used > budget {
+			return messages[:i]
+		}
+	}
+	return messages
+}
+
+// messageTokens estimates a stored message including its attachments. Text
+// attachments are inlined, so they are counted by size.
+func messageTokens(msg models.Message) int {
+	tokens := estimateTokens(msg.Content) + messageOverhead
+	for _, a := range msg.Attachments {
+		if attachmentKind(a.ContentType) == "text" {
+			tokens += int(a.Size / 4)
+		} else {
+			tokens += attachmentTokens
+		}
+	}
+	return tokens
+}
+
+func countTokens(messages []CompletionMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += estimateTokens(msg.Content) + messageOverhead
+	}
+	return total
+}
+
+// toCompletionMessages converts messages, including their attachments, for
+// the model. Stored reasoning is left out.
+func (b *ContextBuilder) toCompletionMessages(ctx context.Context, model string, messages []models.Message) []CompletionMessage {
+	result := make([]CompletionMessage, 0, len(messages))
+	for _, msg := range messages {
+		message := b.attachments.CompletionMessage(ctx, model, msg)
+		message.ToolCalls = msg.ToolCalls
+		message.ToolCallID = msg.ToolCallID
+		message.ToolName = msg.ToolName
+		result = append(result, message)
+	}
+	return result
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"kapi/config"
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// EmbeddingProvider turns texts into vectors whose cosine similarity reflects
+// how close the texts are in meaning.
+type EmbeddingProvider interface {
+	// Model identifies the vectors produced; vectors of different models
+	// are never compared.
+	Model() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// NewEmbeddingProvider returns the configured provider, or nil when semantic
+// search is disabled.
+func NewEmbeddingProvider(cfg config.EmbeddingConfig, upstream config.UpstreamConfig) (EmbeddingProvider, error) {
+	switch cfg.Provider {
+	case "", "none":
+		return nil, nil
+	case "local":
+		return NewLocalEmbeddingProvider(cfg.Dimensions), nil
+	case "openai":
+		if cfg.BaseURL == "" || cfg.Model == "" {
+			return nil, errors.New("EMBEDDING_BASE_URL and EMBEDDING_MODEL are required for openai embeddings")
+		}
+		return NewOpenAIEmbeddingProvider(cfg, newUpstreamClient(upstream)), nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", cfg.Provider)
+	}
+}
+
+// OpenAIEmbeddingProvider calls an OpenAI-compatible /embeddings endpoint,
+// such as OpenAI itself, Ollama or a local inference server.
+type OpenAIEmbeddingProvider struct {
+	baseURL    string
+	apiKey     string
+	model      string
+	dimensions int
+	client     *http.Client
+}
+
+func NewOpenAIEmbeddingProvider(cfg config.EmbeddingConfig, client *http.Client) *OpenAIEmbeddingProvider {
+	return &OpenAIEmbeddingProvider{
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		apiKey:     cfg.APIKey,
+		model:      cfg.Model,
+		dimensions: cfg.Dimensions,
+		client:     client,
+	}
+}
+
+func (p *OpenAIEmbeddingProvider) Model() string {
+	return p.model
+}
+
+func (p *OpenAIEmbeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"model": p.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/embeddings", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &ProviderError{Provider: "embeddings", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding API returned %d vectors for %d texts", len(result.Data), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding API returned unexpected index %d", item.Index)
+		}
+		if p.dimensions > 0 && len(item.Embedding) != p.dimensions {
+			return nil, fmt.Errorf("embedding model returned %d dimensions, EMBEDDING_DIMENSIONS is %d", len(item.Embedding), p.dimensions)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	return vectors, nil
+}
+
+// LocalEmbeddingProvider hashes words and word pairs into a fixed number of
+// dimensions. It needs no network and is deterministic, which makes it
+// suitable for tests and offline development, but it only matches shared
+// words, not paraphrases.
+type LocalEmbeddingProvider struct {
+	dimensions int
+}
+
+func NewLocalEmbeddingProvider(dimensions int) *LocalEmbeddingProvider {
+	if dimensions <= 0 {
+		dimensions = 256
+	}
+	return &LocalEmbeddingProvider{dimensions: dimensions}
+}
+
+func (p *LocalEmbeddingProvider) Model() string {
+	return fmt.Sprintf("local-hash-%d", p.dimensions)
+}
+
+func (p *LocalEmbeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = p.embed(text)
+	}
+	return vectors, nil
+}
+
+func (p *LocalEmbeddingProvider) embed(text string) []float32 {
+	vector := make([]float32, p.dimensions)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	add := func(feature string, weight float32) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		// The top bit picks the sign so that collisions tend to cancel out.
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(p.dimensions)] += weight
+	}
+	for i, word := range words {
+		add(word, 1)
+		if i > 0 {
+			add(words[i-1]+" "+word, 0.5)
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm > 0 {
+		scale := float32(1 / math.Sqrt(norm))
+		for i := range vector {
+			vector[i] *= scale
+		}
+	}
+	return vector
+}
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"kapi/config"
+	"kapi/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrSemanticSearchDisabled = errors.New("semantic search is not enabled on this server")
+
+// semanticSnippetLength is the number of characters of a message returned
+// with a semantic search hit.
+const semanticSnippetLength = 300
+
+// EmbeddingService embeds chat messages in the background and finds the
+// messages closest in meaning to a query. Vectors live in the
+// message_embeddings table, which needs the pgvector extension.
+type EmbeddingService struct {
+	db       *gorm.DB
+	provider EmbeddingProvider
+	cfg      config.EmbeddingConfig
+}
+
+func NewEmbeddingService(db *gorm.DB, provider EmbeddingProvider, cfg config.EmbeddingConfig) *EmbeddingService {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 32
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 10 * time.Second
+	}
+	return &EmbeddingService{db: db, provider: provider, cfg: cfg}
+}
+
+func (es *EmbeddingService) Enabled() bool {
+	return es.provider != nil
+}
+
+// EnsureSchema creates the pgvector extension and the embeddings table. The
+// vector column has no fixed size so that switching models needs no
+// migration; vectors of the old model are replaced by the worker.
+//
+// There is no approximate nearest neighbour index: searches are limited to
+// one user's messages, which an exact scan handles well, while an ANN index
+// would filter after picking candidates across all users and miss hits.
+func (es *EmbeddingService) EnsureSchema() error {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS vector",
+		`CREATE TABLE IF NOT EXISTS message_embeddings (
+			message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+			user_id BIGINT NOT NULL,
+			model TEXT NOT NULL,
+			content_md5 TEXT NOT NULL,
+			embedding vector NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_message_embeddings_user_model ON message_embeddings (user_id, model)",
+		// Messages the provider rejected, such as ones too long for the
+		// model. They are retried once their content or the model changes.
+		`CREATE TABLE IF NOT EXISTS message_embedding_failures (
+			message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+			model TEXT NOT NULL,
+			content_md5 TEXT NOT NULL,
+			error TEXT NOT NULL,
+			failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	}
+	for _, statement := range statements {
+		if err := es.db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run embeds new and edited messages until ctx is cancelled. Each pass
+// drains everything pending, then waits for the poll interval.
+func (es *EmbeddingService) Run(ctx context.Context) {
+	ticker := time.NewTicker(es.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			count, err := es.embedPending(ctx)
+			if err != nil {
+				log.Printf("Failed to embed messages: %v", err)
+				break
+			}
+			if count < es.cfg.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingEmbedding struct {
+	ID      uint
+	UserID  uint
+	Content string
+}
+
+// embedPending embeds one batch of messages that have no vector for the
+// current model yet, or whose content changed since, and returns its size.
+// Streaming and failed replies wait until they are final, and messages the
+// provider rejected are skipped until they change.
+func (es *EmbeddingService) embedPending(ctx context.Context) (int, error) {
+	var pending []pendingEmbedding
+	if err := es.db.WithContext(ctx).Raw(`SELECT m.id, c.user_id, m.content
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		LEFT JOIN message_embeddings e ON e.message_id = m.id
+		LEFT JOIN message_embedding_failures f ON f.message_id = m.id
+			AND f.model = ? AND f.content_md5 = md5(m.content)
+		WHERE m.deleted_at IS NULL AND c.deleted_at IS NULL
+			AND m.role IN ('user', 'assistant')
+			AND m.status NOT IN (?, ?)
+			AND m.content <> ''
+			AND f.message_id IS NULL
+			AND (e.message_id IS NULL OR e.model <> ?
+				OR (e.updated_at < m.updated_at AND e.content_md5 <> md5(m.content)))
+		ORDER BY m.id
+		LIMIT ?`,
+		es.provider.Model(), models.MessageStatusStreaming, models.MessageStatusError, es.provider.Model(), es.cfg.BatchSize,
+	).Scan(&pending).Error; err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	texts := make([]string, len(pending))
+	for i, msg := range pending {
+		texts[i] = msg.Content
+		if es.cfg.MaxChars > 0 {
+			texts[i] = truncateRunes(msg.Content, es.cfg.MaxChars)
+		}
+	}
+
+	vectors, err := es.embed(ctx, texts)
+	if err == nil {
+		for i, msg := range pending {
+			if err := es.store(ctx, msg, vectors[i]); err != nil {
+				return 0, err
+			}
+		}
+		return len(pending), nil
+	}
+	if retryLater(ctx, err) {
+		return 0, err
+	}
+
+	// A single text the provider rejects fails the whole batch, so the
+	// messages are sent one at a time to find and skip it.
+	for i, msg := range pending {
+		vectors, err := es.embed(ctx, texts[i:i+1])
+		if err != nil {
+			if retryLater(ctx, err) {
+				return 0, err
+			}
+			log.Printf("Skipping embedding of message %d: %v", msg.ID, err)
+			if err := es.recordFailure(ctx, msg, err); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := es.store(ctx, msg, vectors[0]); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// embed calls the provider and checks that it returned a vector for every
+// text; pgvector would store a missing one as an empty vector.
+func (es *EmbeddingService) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, err := es.provider.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("embedding provider returned %d vectors for %d texts", len(vectors), len(texts))
+	}
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return nil, fmt.Errorf("embedding provider returned an empty vector for text %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+// retryLater reports whether an embedding call failed for a reason other
+// than the texts sent, such as an outage or a bad API key. Such failures
+// leave the messages pending for the next pass.
+func retryLater(ctx context.Context, err error) bool {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		switch providerErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return true
+		}
+	}
+	return ctx.Err() != nil || isTransient(err)
+}
+
+func (es *EmbeddingService) store(ctx context.Context, msg pendingEmbedding, vector []float32) error {
+	return es.db.WithContext(ctx).Exec(`INSERT INTO message_embeddings (message_id, user_id, model, content_md5, embedding, updated_at)
+		VALUES (?, ?, ?, ?, ?::vector, now())
+		ON CONFLICT (message_id) DO UPDATE SET
+			model = EXCLUDED.model,
+			content_md5 = EXCLUDED.content_md5,
+			embedding = EXCLUDED.embedding,
+			updated_at = EXCLUDED.updated_at`,
+		msg.ID, msg.UserID, es.provider.Model(), contentMD5(msg.Content), vectorLiteral(vector),
+	).Error
+}
+
+// recordFailure stores that the provider rejected the message's current
+// content, so that it is skipped until the content or the model changes.
+func (es *EmbeddingService) recordFailure(ctx context.Context, msg pendingEmbedding, cause error) error {
+	return es.db.WithContext(ctx).Exec(`INSERT INTO message_embedding_failures (message_id, model, content_md5, error, failed_at)
+		VALUES (?, ?, ?, ?, now())
+		ON CONFLICT (message_id) DO UPDATE SET
+			model = EXCLUDED.model,
+			content_md5 = EXCLUDED.content_md5,
+			error = EXCLUDED.error,
+			failed_at = EXCLUDED.failed_at`,
+		msg.ID, es.provider.Model(), contentMD5(msg.Content), cause.Error(),
+	).Error
+}
+
+// contentMD5 matches PostgreSQL's md5() of the same text.
+func contentMD5(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Search returns the user's messages closest in meaning to q.Query, most
+// similar first. Rank is the cosine similarity. The filters of q apply as in
+// keyword search.
+func (es *EmbeddingService) Search(ctx context.Context, userID uint, q *models.SearchQuery) ([]models.SearchHit, error) {
+	if !es.Enabled() {
+		return nil, ErrSemanticSearchDisabled
+	}
+
+	vectors, err := es.embed(ctx, []string{q.Query})
+	if err != nil {
+		return nil, err
+	}
+	query := vectorLiteral(vectors[0])
+
+	conditions := []string{
+		"e.user_id = ?",
+		"e.model = ?",
+		"c.user_id = ?",
+		"c.deleted_at IS NULL",
+		"m.deleted_at IS NULL",
+	}
+	args := []interface{}{query, userID, es.provider.Model(), userID}
+	if q.ChatID != nil {
+		conditions = append(conditions, "m.chat_id = ?")
+		args = append(args, *q.ChatID)
+	}
+	if q.Role != "" {
+		conditions = append(conditions, "m.role = ?")
+		args = append(args, q.Role)
+	}
+	if q.Model != "" {
+		conditions = append(conditions, "m.model = ?")
+		args = append(args, q.Model)
+	}
+	if q.From != nil {
+		conditions = append(conditions, "m.created_at >= ?")
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		conditions = append(conditions, "m.created_at < ?")
+		args = append(args, *q.To)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	args = append(args, limit, q.Offset)
+
+	var hits []models.SearchHit
+	if err := es.db.WithContext(ctx).Raw(`SELECT 'message' AS type, m.chat_id, c.title AS chat_title,
+			m.id AS message_id, m.role, m.model, m.content AS snippet, m.created_at,
+			1 - (e.embedding <=> q.embedding) AS rank
+		FROM message_embeddings e
+		JOIN messages m ON m.id = e.message_id
+		JOIN chats c ON c.id = m.chat_id,
+			(SELECT CAST(? AS vector) AS embedding) AS q
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY e.embedding <=> q.embedding
+		LIMIT ? OFFSET ?`, args...).Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range hits {
+		hits[i].Snippet = html.EscapeString(truncateRunes(hits[i].Snippet, semanticSnippetLength))
+	}
+	return hits, nil
+}
+
+// vectorLiteral formats v in pgvector's text representation.
+func vectorLiteral(v []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(x), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"kapi/config"
+	"net/http"
+	"testing"
+)
+
+type stubEmbeddingProvider struct {
+	vectors [][]float32
+}
+
+func (p *stubEmbeddingProvider) Model() string {
+	return "stub"
+}
+
+func (p *stubEmbeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	return p.vectors, nil
+}
+
+func TestEmbedRejectsMissingVectors(t *testing.T) {
+	cases := map[string][][]float32{
+		"nil vector":   {{1, 0}, nil},
+		"empty vector": {{1, 0}, {}},
+		"too few":      {{1, 0}},
+	}
+	for name, vectors := range cases {
+		es := NewEmbeddingService(nil, &stubEmbeddingProvider{vectors: vectors}, config.EmbeddingConfig{})
+		if _, err := es.embed(context.Background(), []string{"a", "b"}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRetryLaterKeepsMessagesOnlyForFailuresUnrelatedToThem(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&ProviderError{StatusCode: http.StatusTooManyRequests}, true},
+		{&ProviderError{StatusCode: http.StatusBadGateway}, true},
+		{&ProviderError{StatusCode: http.StatusUnauthorized}, true},
+		{ErrUpstreamTimeout, true},
+		{&ProviderError{StatusCode: http.StatusBadRequest}, false},
+		{errors.New("embedding provider returned an empty vector for text 0"), false},
+	}
+	for _, tc := range cases {
+		if got := retryLater(ctx, tc.err); got != tc.want {
+			t.Errorf("retryLater(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if !retryLater(cancelled, errors.New("context canceled")) {
+		t.Error("expected a cancelled pass to keep its messages")
+	}
+}
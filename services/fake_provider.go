@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"kapi/config"
+	"kapi/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fakeProviderName = "fake"
+
+// FakeProvider is a deterministic, offline provider for tests and local
+// development. The model string selects a script and can override the
+// configured defaults:
+//
+//	fake:echo                      echoes the last user message
+//	fake:canned                    streams the configured canned response
+//	fake:echo?chunk=3&latency=20ms chunk size in runes and delay per chunk
+//	fake:canned?error_after=2      fails after two chunks have been sent
+//	fake:canned?finish=length      reports a custom finish reason
+//	fake:canned?status=429         fails before streaming with an API error
+//	fake:canned?text=hello         streams the given text
+//	fake:canned?reasoning=hmm      streams reasoning before the text
+//	fake:echo?tool=calculator&args={"expression":"1+1"}
+//	                               calls the tool first; echo then repeats
+//	                               the tool result
+type FakeProvider struct {
+	cfg config.FakeLLMConfig
+}
+
+type fakeScript struct {
+	text         string
+	reasoning    string
+	chunkSize    int
+	latency      time.Duration
+	errorAfter   int
+	finishReason string
+	status       int
+	tool         string
+	toolArgs     string
+}
+
+func NewFakeProvider(cfg config.FakeLLMConfig) *FakeProvider {
+	return &FakeProvider{cfg: cfg}
+}
+
+func (p *FakeProvider) Name() string {
+	return fakeProviderName
+}
+
+func (p *FakeProvider) RequiresUserKey() bool {
+	return false
+}
+
+func (p *FakeProvider) StreamChat(ctx context.Context, apiKey string, req *CompletionRequest, onDelta func(StreamDelta)) (*CompletionResult, error) {
+	name, _, _ := strings.Cut(req.Model, "?")
+	script, err := p.script(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if script.status != 0 && script.status != http.StatusOK {
+		return nil, &ProviderError{
+			Provider:   fakeProviderName,
+			StatusCode: script.status,
+			Body:       fmt.Sprintf(`{"error":{"message":"simulated %d response"}}`, script.status),
+		}
+	}
+
+	if script.tool != "" && offersTool(req.Tools, script.tool) && !answersTool(req.Messages) {
+		return &CompletionResult{
+			Model:        fakeProviderName + ":" + name,
+			FinishReason: "tool_calls",
+			GenerationID: fmt.Sprintf("fake-%d", time.Now().UnixNano()),
+			ToolCalls: []models.ToolCall{
+				{ID: fmt.Sprintf("call_fake_%d", len(req.Messages)), Name: script.tool, Arguments: script.toolArgs},
+			},
+		}, nil
+	}
+
+	for _, chunk := range chunkRunes(script.reasoning, script.chunkSize) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		onDelta(StreamDelta{Reasoning: chunk})
+	}
+
+	for i, chunk := range chunkRunes(script.text, script.chunkSize) {
+		if script.errorAfter > 0 && i >= script.errorAfter {
+			return nil, fmt.Errorf("fake provider: simulated failure after %d chunks", script.errorAfter)
+		}
+
+		if script.latency > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(script.latency):
+			}
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		onDelta(StreamDelta{Content: chunk})
+	}
+	// A reply with no more chunks than error_after still fails, at its end.
+	if script.errorAfter > 0 {
+		return nil, fmt.Errorf("fake provider: simulated failure after %d chunks", script.errorAfter)
+	}
+
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += estimateTokens(msg.Content)
+	}
+	reasoningTokens := estimateTokens(script.reasoning)
+	completionTokens := estimateTokens(script.text) + reasoningTokens
+
+	return &CompletionResult{
+		Model:        fakeProviderName + ":" + name,
+		FinishReason: script.finishReason,
+		GenerationID: fmt.Sprintf("fake-%d", time.Now().UnixNano()),
+		Usage: TokenUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			ReasoningTokens:  reasoningTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}, nil
+}
+
+func (p *FakeProvider) ListModels(ctx context.Context, apiKey string) ([]ModelInfo, error) {
+	return []ModelInfo{
+		{ID: fakeProviderName + ":echo", Name: "Fake echo", Provider: fakeProviderName, InputModalities: []string{"text"}, SupportsTools: true},
+		{ID: fakeProviderName + ":canned", Name: "Fake canned response", Provider: fakeProviderName, InputModalities: []string{"text"}, SupportsTools: true},
+	}, nil
+}
+
+func (p *FakeProvider) ValidateKey(ctx context.Context, apiKey string) error {
+	return nil
+}
+
+// script builds the response plan from the configured defaults and any
+// overrides encoded in the model string.
+func (p *FakeProvider) script(req *CompletionRequest) (*fakeScript, error) {
+	name, rawQuery, _ := strings.Cut(req.Model, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("fake provider: invalid model options: %v", err)
+	}
+
+	script := &fakeScript{
+		text:         p.cfg.Response,
+		chunkSize:    p.cfg.ChunkSize,
+		latency:      p.cfg.Latency,
+		errorAfter:   p.cfg.ErrorAfter,
+		finishReason: p.cfg.FinishReason,
+	}
+
+	if name == "echo" {
+		script.text = lastUserContent(req.Messages)
+		if answersTool(req.Messages) {
+			script.text = req.Messages[len(req.Messages)-1].Content
+		}
+	}
+	if text := params.Get("text"); text != "" {
+		script.text = text
+	}
+	script.reasoning = params.Get("reasoning")
+	if v := params.Get("chunk"); v != "" {
+		if script.chunkSize, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("fake provider: invalid chunk %q", v)
+		}
+	}
+	if v := params.Get("latency"); v != "" {
+		if script.latency, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("fake provider: invalid latency %q", v)
+		}
+	}
+	if v := params.Get("error_after"); v != "" {
+		if script.errorAfter, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("fake provider: invalid error_after %q", v)
+		}
+	}
+	if v := params.Get("status"); v != "" {
+		if script.status, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("fake provider: invalid status %q", v)
+		}
+	}
+	if v := params.Get("finish"); v != "" {
+		script.finishReason = v
+	}
+	script.tool = params.Get("tool")
+	script.toolArgs = params.Get("args")
+	if script.toolArgs == "" {
+		script.toolArgs = "{}"
+	}
+
+	return script, nil
+}
+
+func lastUserContent(messages []CompletionMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+func offersTool(tools []ToolDefinition, name string) bool {
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// answersTool reports whether the request continues after a tool result.
+func answersTool(messages []CompletionMessage) bool {
+	return len(messages) > 0 && messages[len(messages)-1].Role == "tool"
+}
+
+// chunkRunes splits text into pieces of at most size runes so multi-byte
+// characters are never cut in half.
+func chunkRunes(text string, size int) []string {
+	runes := []rune(text)
+	if size <= 0 || size >= len(runes) {
+		if len(runes) == 0 {
+			return nil
+		}
+		return []string{text}
+	}
+
+	chunks := make([]string, 0, len(runes)/size+1)
+	for start := 0; start < len(runes); start += size {
+		end := start + size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+	}
+	return chunks
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"kapi/config"
+)
+
+func streamFake(t *testing.T, model string, messages ...CompletionMessage) ([]StreamDelta, *CompletionResult, error) {
+	t.Helper()
+	provider := NewFakeProvider(config.FakeLLMConfig{Response: "canned reply"})
+	var deltas []StreamDelta
+	result, err := provider.StreamChat(context.Background(), "", &CompletionRequest{
+		Model:    model,
+		Messages: messages,
+	}, func(delta StreamDelta) {
+		deltas = append(deltas, delta)
+	})
+	return deltas, result, err
+}
+
+func TestFakeProviderStreamsInChunks(t *testing.T) {
+	deltas, result, err := streamFake(t, "echo?chunk=2&reasoning=hm", CompletionMessage{Role: "user", Content: "héllo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content, reasoning strings.Builder
+	for _, delta := range deltas {
+		content.WriteString(delta.Content)
+		reasoning.WriteString(delta.Reasoning)
+	}
+	if content.String() != "héllo" || reasoning.String() != "hm" {
+		t.Fatalf("streamed %q with reasoning %q", content.String(), reasoning.String())
+	}
+	if len(deltas) != 4 {
+		t.Fatalf("expected 1 reasoning and 3 content chunks, got %d", len(deltas))
+	}
+	if result.Usage.TotalTokens == 0 {
+		t.Fatal("expected usage to be reported")
+	}
+}
+
+func TestFakeProviderErrorAfter(t *testing.T) {
+	deltas, _, err := streamFake(t, "canned?chunk=1&text=abcd&error_after=2")
+	if err == nil || len(deltas) != 2 {
+		t.Fatalf("expected a failure after 2 chunks, got %d chunks and %v", len(deltas), err)
+	}
+
+	// Fewer chunks than error_after: the failure comes at the end.
+	deltas, _, err = streamFake(t, "canned?chunk=1&text=ab&error_after=5")
+	if err == nil || len(deltas) != 2 {
+		t.Fatalf("expected a failure after all 2 chunks, got %d chunks and %v", len(deltas), err)
+	}
+}
+
+func TestFakeProviderStatus(t *testing.T) {
+	_, _, err := streamFake(t, "canned?status=429")
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || providerErr.StatusCode != 429 {
+		t.Fatalf("expected a 429 provider error, got %v", err)
+	}
+	if !isTransient(err) {
+		t.Fatal("expected a 429 to be retried")
+	}
+}
+
+func TestFakeProviderCallsOfferedTool(t *testing.T) {
+	provider := NewFakeProvider(config.FakeLLMConfig{})
+	result, err := provider.StreamChat(context.Background(), "", &CompletionRequest{
+		Model:    "echo?tool=calculator&args=" + `{"expression":"1+1"}`,
+		Messages: []CompletionMessage{{Role: "user", Content: "add"}},
+		Tools:    []ToolDefinition{{Name: "calculator"}},
+	}, func(StreamDelta) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ToolCalls) != 1 || result.ToolCalls[0].Name != "calculator" {
+		t.Fatalf("expected a calculator call, got %+v", result.ToolCalls)
+	}
+}
+
+// TestFakeGenerationStreamsToSubscribers runs a fake reply through a
+// generation the way the chat service does and reads it as a client would.
+func TestFakeGenerationStreamsToSubscribers(t *testing.T) {
+	generations := NewGenerationService(NewHubService(), time.Minute)
+	gen, ctx, err := generations.Start(1, 1, "fake:echo?chunk=3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, events, unsubscribe := gen.Subscribe(0)
+	defer unsubscribe()
+
+	go func() {
+		provider := NewFakeProvider(config.FakeLLMConfig{})
+		_, err := provider.StreamChat(ctx, "", &CompletionRequest{
+			Model:    "echo?chunk=3",
+			Messages: []CompletionMessage{{Role: "user", Content: "stream me please"}},
+		}, func(delta StreamDelta) {
+			gen.AppendReasoning(delta.Reasoning)
+			gen.Append(delta.Content)
+		})
+		generations.Finish(gen, nil, err)
+	}()
+
+	var streamed strings.Builder
+	for event := range events {
+		switch event.Type {
+		case GenerationEventDelta:
+			if event.Offset != streamed.Len() {
+				t.Fatalf("delta at offset %d, expected %d", event.Offset, streamed.Len())
+			}
+			streamed.WriteString(event.Content)
+		case GenerationEventError:
+			t.Fatal(event.Err)
+		}
+	}
+	if streamed.String() != "stream me please" || gen.Content() != streamed.String() {
+		t.Fatalf("streamed %q, buffered %q", streamed.String(), gen.Content())
+	}
+
+	// A late client replays the buffer and gets the final event.
+	buffered, late, _ := gen.Subscribe(4)
+	if buffered != "am me please" {
+		t.Fatalf("replayed %q", buffered)
+	}
+	if event := <-late; event.Type != GenerationEventDone {
+		t.Fatalf("expected done, got %s", event.Type)
+	}
+}
+
+func TestFakeGenerationCancel(t *testing.T) {
+	generations := NewGenerationService(NewHubService(), time.Minute)
+	gen, ctx, err := generations.Start(2, 1, "fake:canned", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		provider := NewFakeProvider(config.FakeLLMConfig{})
+		_, err := provider.StreamChat(ctx, "", &CompletionRequest{
+			Model: "canned?text=abcdef&chunk=1&latency=50ms",
+		}, func(delta StreamDelta) {
+			gen.Append(delta.Content)
+		})
+		done <- err
+	}()
+
+	if err := generations.Cancel(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(context.Cause(ctx), ErrGenerationCancelled) || err == nil {
+			t.Fatalf("expected the stream to stop on cancel, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream did not stop after cancel")
+	}
+}
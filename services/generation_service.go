@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"kapi/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrGenerationInProgress = errors.New("a response is already being generated for this chat")
+	ErrNoActiveGeneration   = errors.New("no generation in progress for this chat")
+	// ErrGenerationCancelled is the context cause used when a user stops a
+	// generation explicitly.
+	ErrGenerationCancelled = errors.New("generation cancelled by user")
+)
+
+const (
+	GenerationEventDelta     = "delta"
+	GenerationEventReasoning = "reasoning"
+	GenerationEventDone      = "done"
+	GenerationEventError     = "error"
+)
+
+// Tool events carry the stored tool call or tool result message.
+const (
+	GenerationEventToolCall   = "tool_call"
+	GenerationEventToolResult = "tool_result"
+)
+
+// GenerationEventFormatRetry reports that the reply did not match the
+// requested response format and the model is asked again. Content holds the
+// problems found.
+const GenerationEventFormatRetry = "format_retry"
+
+// GenerationEventReset reports that the text streamed so far will not be
+// part of the reply: it became a tool call or failed the response format.
+// The buffer starts over and later offsets count from zero again.
+const GenerationEventReset = "reset"
+
+// Retry events report a failed attempt before the first token: it is either
+// repeated (retry) or handed to the next fallback model (fallback). Content
+// is the model tried next and Err the failure.
+const (
+	GenerationEventRetry    = "retry"
+	GenerationEventFallback = "fallback"
+)
+
+// subscriberBuffer bounds how far a slow reader may fall behind before it is
+// dropped; it can reattach from its last offset.
+const subscriberBuffer = 256
+
+// GenerationEvent is delivered to subscribers of a Generation. Offset is the
+// byte position of Content within the full response text.
+type GenerationEvent struct {
+	Type    string
+	Content string
+	Offset  int
+	Message *models.Message
+	Err     error
+}
+
+// Generation is a server-side job producing an assistant reply. It runs
+// independently of the HTTP request that started it and buffers its output
+// so that any of the user's clients can attach and replay from an offset.
+type Generation struct {
+	ID        string    `json:"id"`
+	ChatID    uint      `json:"chat_id"`
+	UserID    uint      `json:"user_id"`
+	MessageID uint      `json:"message_id"`
+	Model     string    `json:"model"`
+	StartedAt time.Time `json:"started_at"`
+	ClientID  string    `json:"-"`
+	// ComparisonID is shared by the generations of a multi-model comparison.
+	ComparisonID string `json:"comparison_id,omitempty"`
+
+	cancel      context.CancelCauseFunc
+	mu          sync.Mutex
+	content     strings.Builder
+	reasoning   strings.Builder
+	done        bool
+	err         error
+	message     *models.Message
+	subscribers map[chan GenerationEvent]struct{}
+}
+
+// Append adds streamed text to the buffer and forwards it to subscribers.
+func (g *Generation) Append(text string) {
+	if text == "" {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	event := GenerationEvent{Type: GenerationEventDelta, Content: text, Offset: g.content.Len()}
+	g.content.WriteString(text)
+
+	g.broadcast(event)
+}
+
+// AppendReasoning forwards model reasoning to subscribers. Reasoning is kept
+// apart from the content buffer and is not replayed.
+func (g *Generation) AppendReasoning(text string) {
+	if text == "" {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.reasoning.WriteString(text)
+	g.broadcast(GenerationEvent{Type: GenerationEventReasoning, Content: text, Offset: g.content.Len()})
+}
+
+// AppendToolMessage forwards a stored tool call or tool result to
+// subscribers. Like reasoning, it is not replayed.
+func (g *Generation) AppendToolMessage(eventType string, message *models.Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.broadcast(GenerationEvent{Type: eventType, Offset: g.content.Len(), Message: message})
+}
+
+// AppendRetry tells subscribers that an attempt failed and is retried, with
+// the same or a fallback model.
+func (g *Generation) AppendRetry(eventType, model string, cause error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.broadcast(GenerationEvent{Type: eventType, Content: model, Offset: g.content.Len(), Err: cause})
+}
+
+// AppendFormatRetry tells subscribers that the text streamed in this round
+// is being discarded and regenerated.
+func (g *Generation) AppendFormatRetry(problems string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.broadcast(GenerationEvent{Type: GenerationEventFormatRetry, Content: problems, Offset: g.content.Len()})
+}
+
+// Reset discards the text and reasoning of a round that did not produce the
+// reply, so that clients attaching later replay only the reply itself.
+func (g *Generation) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.content.Reset()
+	g.reasoning.Reset()
+	g.broadcast(GenerationEvent{Type: GenerationEventReset})
+}
+
+// broadcast sends an event to every subscriber, dropping those that fell
+// behind. The caller holds g.mu.
+func (g *Generation) broadcast(event GenerationEvent) {
+	for ch := range g.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(g.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Content returns everything generated so far.
+func (g *Generation) Content() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.content.String()
+}
+
+// Reasoning returns the model reasoning received so far.
+func (g *Generation) Reasoning() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reasoning.String()
+}
+
+// Subscribe returns the buffered text from offset and a channel of subsequent
+// events. The channel is closed after the final done or error event, or if
+// the subscriber falls too far behind. The returned function must be called
+// to release the subscription.
+func (g *Generation) Subscribe(offset int) (string, <-chan GenerationEvent, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	buffered := g.content.String()
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(buffered) {
+		offset = len(buffered)
+	}
+
+	ch := make(chan GenerationEvent, subscriberBuffer)
+	if g.done {
+		ch <- g.finalEvent()
+		close(ch)
+		return buffered[offset:], ch, func() {}
+	}
+
+	g.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if _, ok := g.subscribers[ch]; ok {
+			delete(g.subscribers, ch)
+			close(ch)
+		}
+	}
+	return buffered[offset:], ch, unsubscribe
+}
+
+// Done reports whether the generation has finished.
+func (g *Generation) Done() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+func (g *Generation) finish(message *models.Message, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.done = true
+	g.message = message
+	g.err = err
+
+	final := g.finalEvent()
+	for ch := range g.subscribers {
+		select {
+		case ch <- final:
+		default:
+		}
+		close(ch)
+	}
+	g.subscribers = map[chan GenerationEvent]struct{}{}
+}
+
+func (g *Generation) finalEvent() GenerationEvent {
+	if g.err != nil {
+		return GenerationEvent{Type: GenerationEventError, Offset: g.content.Len(), Err: g.err, Message: g.message}
+	}
+	return GenerationEvent{Type: GenerationEventDone, Offset: g.content.Len(), Message: g.message}
+}
+
+// GenerationService tracks generation jobs. At most one job runs per chat: a
+// single reply, or one generation per model for a comparison. Finished jobs
+// are kept for a while so late clients can still replay them.
+type GenerationService struct {
+	mu         sync.Mutex
+	jobs       map[uint][]*Generation
+	hubService *HubService
+	retention  time.Duration
+}
+
+func NewGenerationService(hubService *HubService, retention time.Duration) *GenerationService {
+	return &GenerationService{
+		jobs:       map[uint][]*Generation{},
+		hubService: hubService,
+		retention:  retention,
+	}
+}
+
+// Start registers a new generation for the chat. The returned context is
+// detached from any request and is only cancelled through Cancel.
+func (gs *GenerationService) Start(chatID, userID uint, model, clientID string) (*Generation, context.Context, error) {
+	gens, contexts, err := gs.StartGroup(chatID, userID, []string{model}, clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gens[0], contexts[0], nil
+}
+
+// StartGroup registers one generation per model as a single job for the chat,
+// as for a comparison. Each generation has its own context.
+func (gs *GenerationService) StartGroup(chatID, userID uint, modelIDs []string, clientID string) ([]*Generation, []context.Context, error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for _, existing := range gs.jobs[chatID] {
+		if !existing.Done() {
+			return nil, nil, ErrGenerationInProgress
+		}
+	}
+
+	var comparisonID string
+	if len(modelIDs) > 1 {
+		comparisonID = uuid.New().String()
+	}
+
+	gens := make([]*Generation, len(modelIDs))
+	contexts := make([]context.Context, len(modelIDs))
+	for i, model := range modelIDs {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		gens[i] = &Generation{
+			ID:           uuid.New().String(),
+			ChatID:       chatID,
+			UserID:       userID,
+			Model:        model,
+			StartedAt:    time.Now(),
+			ClientID:     clientID,
+			ComparisonID: comparisonID,
+			cancel:       cancel,
+			subscribers:  map[chan GenerationEvent]struct{}{},
+		}
+		contexts[i] = ctx
+	}
+	gs.jobs[chatID] = gens
+	return gens, contexts, nil
+}
+
+// Announce tells the user's other devices that a generation started so they
+// can attach to it.
+func (gs *GenerationService) Announce(gen *Generation) {
+	gs.hubService.BroadcastToUserExceptByClientID(gen.UserID, "generation_started", gen, gen.ClientID)
+}
+
+// Finish marks the generation as done, wakes up subscribers and notifies the
+// user's devices of the outcome.
+func (gs *GenerationService) Finish(gen *Generation, message *models.Message, err error) {
+	gen.finish(message, err)
+	gen.cancel(nil)
+
+	// Devices load the reasoning on demand rather than with every event.
+	if message != nil && message.Reasoning != "" {
+		announced := *message
+		announced.Reasoning = ""
+		message = &announced
+	}
+
+	switch {
+	case err != nil:
+		gs.hubService.BroadcastToUser(gen.UserID, "generation_failed", map[string]interface{}{
+			"chat_id":       gen.ChatID,
+			"generation_id": gen.ID,
+			"error":         err.Error(),
+			"message":       message,
+		})
+	case message != nil && message.Status == models.MessageStatusStopped:
+		gs.hubService.BroadcastToUser(gen.UserID, "generation_cancelled", map[string]interface{}{
+			"chat_id": gen.ChatID,
+			"message": message,
+		})
+	case message != nil:
+		gs.hubService.BroadcastToUserExceptByClientID(gen.UserID, "message_created", message, gen.ClientID)
+	}
+
+	time.AfterFunc(gs.retention, func() {
+		gs.mu.Lock()
+		defer gs.mu.Unlock()
+		jobs := gs.jobs[gen.ChatID]
+		for i, job := range jobs {
+			if job == gen {
+				jobs = append(jobs[:i:i], jobs[i+1:]...)
+				break
+			}
+		}
+		if len(jobs) == 0 {
+			delete(gs.jobs, gen.ChatID)
+		} else {
+			gs.jobs[gen.ChatID] = jobs
+		}
+	})
+}
+
+// Cancel aborts the running generations for the chat, if the user owns them.
+func (gs *GenerationService) Cancel(chatID, userID uint) error {
+	cancelled := false
+	for _, gen := range gs.List(chatID, userID) {
+		if !gen.Done() {
+			gen.cancel(ErrGenerationCancelled)
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		return ErrNoActiveGeneration
+	}
+	return nil
+}
+
+// Get returns the current or most recently finished generation for the chat.
+// For a comparison it is the one of the first model.
+func (gs *GenerationService) Get(chatID, userID uint) (*Generation, bool) {
+	gens := gs.List(chatID, userID)
+	if len(gens) == 0 {
+		return nil, false
+	}
+	return gens[0], true
+}
+
+// List returns the generations of the chat's current or most recent job.
+func (gs *GenerationService) List(chatID, userID uint) []*Generation {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	var gens []*Generation
+	for _, gen := range gs.jobs[chatID] {
+		if gen.UserID == userID {
+			gens = append(gens, gen)
+		}
+	}
+	return gens
+}
+
+// IsRunning reports whether a generation is in progress for the chat.
+func (gs *GenerationService) IsRunning(chatID, userID uint) bool {
+	for _, gen := range gs.List(chatID, userID) {
+		if !gen.Done() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerationResetDropsDiscardedRounds(t *testing.T) {
+	generations := NewGenerationService(NewHubService(), time.Minute)
+	gen, _, err := generations.Start(1, 1, "fake:echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, events, unsubscribe := gen.Subscribe(0)
+	defer unsubscribe()
+
+	gen.Append("rejected")
+	gen.AppendReasoning("thinking")
+	gen.Reset()
+	gen.Append("reply")
+
+	for _, want := range []GenerationEvent{
+		{Type: GenerationEventDelta, Content: "rejected", Offset: 0},
+		{Type: GenerationEventReasoning, Content: "thinking", Offset: 8},
+		{Type: GenerationEventReset},
+		{Type: GenerationEventDelta, Content: "reply", Offset: 0},
+	} {
+		if got := <-events; got.Type != want.Type || got.Content != want.Content || got.Offset != want.Offset {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	if gen.Content() != "reply" || gen.Reasoning() != "" {
+		t.Fatalf("buffered %q and %q", gen.Content(), gen.Reasoning())
+	}
+	replay, _, release := gen.Subscribe(0)
+	defer release()
+	if replay != "reply" {
+		t.Fatalf("replayed %q", replay)
+	}
+}
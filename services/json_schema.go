@@ -0,0 +1,484 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kapi/models"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidResponseFormat = errors.New("invalid response_format")
+
+// SchemaValidationError is returned when a reply still does not match the
+// requested response format after all retries.
+type SchemaValidationError struct {
+	Errors []string
+	// Content is the last reply the model produced.
+	Content string
+}
+
+func (e *SchemaValidationError) Error() string {
+	return "reply does not match the response format: " + strings.Join(e.Errors, "; ")
+}
+
+// maxSchemaErrors bounds how many problems are reported for one reply.
+const maxSchemaErrors = 10
+
+// checkResponseFormat verifies that a requested schema can be used before a
+// generation starts.
+func checkResponseFormat(format *models.ResponseFormat) error {
+	if format == nil || format.JSONSchema == nil {
+		return nil
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+		return fmt.Errorf("%w: schema must be a JSON object", ErrInvalidResponseFormat)
+	}
+	if err := checkSchema(schema); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidResponseFormat, err)
+	}
+	return nil
+}
+
+// responseFormatPrompt tells the model about the expected format. It is sent
+// even to models that enforce the format natively, which makes little
+// difference to them and helps the rest.
+func responseFormatPrompt(format *models.ResponseFormat) string {
+	if format.JSONSchema == nil {
+		return "Reply with a single JSON object and nothing else."
+	}
+	return "Reply with a single JSON value that conforms to the following JSON Schema, " +
+		"without any surrounding text or code fences:\n" + string(format.JSONSchema.Schema)
+}
+
+// validateResponse extracts the JSON value from a reply and checks it against
+// the format. It returns the compact JSON on success.
+func validateResponse(content string, format *models.ResponseFormat) (string, []string) {
+	raw := extractJSON(content)
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", []string{"reply is not valid JSON: " + err.Error()}
+	}
+	if decoder.More() {
+		return "", []string{"reply contains more than one JSON value"}
+	}
+
+	if format.JSONSchema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", []string{"reply is not a JSON object"}
+		}
+	} else {
+		var schema interface{}
+		if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+			return "", []string{"schema is not valid JSON"}
+		}
+		v := &schemaValidator{}
+		v.validate(schema, value, "$")
+		if len(v.errors) > 0 {
+			return "", v.errors
+		}
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(raw)); err != nil {
+		return raw, nil
+	}
+	return compact.String(), nil
+}
+
+// extractJSON strips whitespace and a surrounding markdown code fence.
+func extractJSON(content string) string {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "```") {
+		content = strings.TrimPrefix(content, "```")
+		if newline := strings.Index(content, "\n"); newline >= 0 {
+			content = content[newline+1:]
+		}
+		content = strings.TrimSuffix(strings.TrimSpace(content), "```")
+	}
+	return strings.TrimSpace(content)
+}
+
+// schemaValidator implements the commonly used subset of JSON Schema: type,
+// enum, const, properties, required, additionalProperties, items, the size
+// and range keywords, pattern, and allOf/anyOf/oneOf/not. Schemas using
+// $ref, $defs or format are rejected by checkSchema; other unknown keywords
+// are ignored.
+type schemaValidator struct {
+	errors []string
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if len(v.errors) < maxSchemaErrors {
+		v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// matches reports whether value satisfies schema without recording errors.
+func matches(schema, value interface{}) bool {
+	v := &schemaValidator{}
+	v.validate(schema, value, "$")
+	return len(v.errors) == 0
+}
+
+func (v *schemaValidator) validate(schemaValue, value interface{}, path string) {
+	switch schema := schemaValue.(type) {
+	case bool:
+		if !schema {
+			v.fail(path, "no value is allowed here")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObjectSchema(schema, value, path)
+	}
+}
+
+func (v *schemaValidator) validateObjectSchema(schema map[string]interface{}, value interface{}, path string) {
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		v.fail(path, "expected %s, got %s", describeType(t), jsonType(value))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "value is not one of the allowed options")
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		v.fail(path, "value must be %v", c)
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, val, path)
+	case []interface{}:
+		v.validateArray(schema, val, path)
+	case string:
+		v.validateString(schema, val, path)
+	case json.Number:
+		v.validateNumber(schema, val, path)
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if matches(sub, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "value does not match any of the allowed schemas")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		count := 0
+		for _, sub := range oneOf {
+			if matches(sub, value) {
+				count++
+			}
+		}
+		if count != 1 {
+			v.fail(path, "value must match exactly one schema, matched %d", count)
+		}
+	}
+	if not, ok := schema["not"]; ok && matches(not, value) {
+		v.fail(path, "value matches a disallowed schema")
+	}
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, object map[string]interface{}, path string) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := object[key]; !present {
+					v.fail(path, "missing required property %q", key)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "." + key
+		if sub, ok := properties[key]; ok {
+			v.validate(sub, object[key], childPath)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(path, "property %q is not allowed", key)
+			}
+		case map[string]interface{}:
+			v.validate(additional, object[key], childPath)
+		}
+	}
+
+	if min, ok := schemaInt(schema, "minProperties"); ok && len(object) < min {
+		v.fail(path, "must have at least %d properties", min)
+	}
+	if max, ok := schemaInt(schema, "maxProperties"); ok && len(object) > max {
+		v.fail(path, "must have at most %d properties", max)
+	}
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, array []interface{}, path string) {
+	if items, ok := schema["items"]; ok {
+		for i, item := range array {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	if min, ok := schemaInt(schema, "minItems"); ok && len(array) < min {
+		v.fail(path, "must have at least %d items", min)
+	}
+	if max, ok := schemaInt(schema, "maxItems"); ok && len(array) > max {
+		v.fail(path, "must have at most %d items", max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					v.fail(path, "items %d and %d are equal", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateString(schema map[string]interface{}, s string, path string) {
+	length := utf8.RuneCountInString(s)
+	if min, ok := schemaInt(schema, "minLength"); ok && length < min {
+		v.fail(path, "must be at least %d characters", min)
+	}
+	if max, ok := schemaInt(schema, "maxLength"); ok && length > max {
+		v.fail(path, "must be at most %d characters", max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(s) {
+			v.fail(path, "does not match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(schema map[string]interface{}, number json.Number, path string) {
+	n, err := number.Float64()
+	if err != nil {
+		v.fail(path, "invalid number")
+		return
+	}
+	if min, ok := schemaFloat(schema, "minimum"); ok && n < min {
+		v.fail(path, "must be >= %v", min)
+	}
+	if max, ok := schemaFloat(schema, "maximum"); ok && n > max {
+		v.fail(path, "must be <= %v", max)
+	}
+	if min, ok := schemaFloat(schema, "exclusiveMinimum"); ok && n <= min {
+		v.fail(path, "must be > %v", min)
+	}
+	if max, ok := schemaFloat(schema, "exclusiveMaximum"); ok && n >= max {
+		v.fail(path, "must be < %v", max)
+	}
+	if step, ok := schemaFloat(schema, "multipleOf"); ok && step > 0 {
+		if q := n / step; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "must be a multiple of %v", step)
+		}
+	}
+}
+
+func matchesType(t, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, value)
+	case []interface{}:
+		for _, option := range t {
+			if name, ok := option.(string); ok && isType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	actual := jsonType(value)
+	if name == "number" && actual == "integer" {
+		return true
+	}
+	return name == actual
+}
+
+// jsonType names the JSON type of a decoded value; numbers without a
+// fractional part count as integers.
+func jsonType(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := val.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func describeType(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// jsonEqual compares decoded JSON values, treating numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	an, aIsNumber := toFloat(a)
+	bn, bIsNumber := toFloat(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && an == bn
+	}
+	return reflect.DeepEqual(normalizeNumbers(a), normalizeNumbers(b))
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// normalizeNumbers converts json.Number values to float64 so that schema
+// values (decoded as float64) and reply values compare equal.
+func normalizeNumbers(value interface{}) interface{} {
+	switch val := value.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, item := range val {
+			result[i] = normalizeNumbers(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			result[key] = normalizeNumbers(item)
+		}
+		return result
+	}
+	return value
+}
+
+func schemaFloat(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+func schemaInt(schema map[string]interface{}, key string) (int, bool) {
+	n, ok := schema[key].(float64)
+	return int(n), ok
+}
+
+// unsupportedSchemaKeywords are rejected up front because the validator does
+// not enforce them, and accepting them would promise checks that never run.
+var unsupportedSchemaKeywords = []string{"$ref", "$defs", "definitions", "format"}
+
+// checkSchema rejects schemas using keywords the validator does not support
+// and patterns Go cannot compile, so that they fail up front instead of
+// being silently ignored. Only schema positions are inspected: a property
+// named "pattern" or "format" is not a keyword.
+func checkSchema(schema interface{}) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := s[keyword]; ok {
+			return fmt.Errorf("the %s keyword is not supported", keyword)
+		}
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	var subschemas []interface{}
+	if properties, ok := s["properties"].(map[string]interface{}); ok {
+		for _, sub := range properties {
+			subschemas = append(subschemas, sub)
+		}
+	}
+	for _, key := range []string{"additionalProperties", "not"} {
+		if sub, ok := s[key]; ok {
+			subschemas = append(subschemas, sub)
+		}
+	}
+	switch items := s["items"].(type) {
+	case []interface{}:
+		subschemas = append(subschemas, items...)
+	case map[string]interface{}:
+		subschemas = append(subschemas, items)
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		if list, ok := s[key].([]interface{}); ok {
+			subschemas = append(subschemas, list...)
+		}
+	}
+
+	for _, sub := range subschemas {
+		if err := checkSchema(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"kapi/models"
+)
+
+func schemaFormat(schema string) *models.ResponseFormat {
+	return &models.ResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &models.JSONSchemaFormat{Schema: json.RawMessage(schema)},
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	cases := []struct {
+		name    string
+		schema  string
+		content string
+		valid   bool
+	}{
+		{"type match", `{"type": "string"}`, `"hi"`, true},
+		{"type mismatch", `{"type": "string"}`, `42`, false},
+		{"integer is a number", `{"type": "number"}`, `3`, true},
+		{"fraction is not an integer", `{"type": "integer"}`, `3.5`, false},
+		{"type list", `{"type": ["string", "null"]}`, `null`, true},
+
+		{"required present", `{"type": "object", "required": ["a"]}`, `{"a": 1}`, true},
+		{"required missing", `{"type": "object", "required": ["a"]}`, `{"b": 1}`, false},
+
+		{"enum match", `{"enum": ["red", "green"]}`, `"green"`, true},
+		{"enum miss", `{"enum": ["red", "green"]}`, `"blue"`, false},
+		{"enum number", `{"enum": [1, 2]}`, `2.0`, true},
+
+		{"anyOf match", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `5`, true},
+		{"anyOf miss", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, false},
+		{"oneOf exactly one", `{"oneOf": [{"type": "string"}, {"minimum": 10}]}`, `5`, false},
+		{"oneOf one match", `{"oneOf": [{"type": "integer"}, {"type": "string"}]}`, `5`, true},
+		{"oneOf two matches", `{"oneOf": [{"type": "integer"}, {"minimum": 1}]}`, `5`, false},
+
+		{"additional allowed", `{"properties": {"a": {}}}`, `{"a": 1, "b": 2}`, true},
+		{"additional forbidden", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, false},
+		{"additional schema", `{"properties": {"a": {}}, "additionalProperties": {"type": "string"}}`, `{"a": 1, "b": 2}`, false},
+
+		{"pattern match", `{"type": "string", "pattern": "^[a-z]+$"}`, `"abc"`, true},
+		{"pattern miss", `{"type": "string", "pattern": "^[a-z]+$"}`, `"ABC"`, false},
+		{"property named pattern", `{"properties": {"pattern": {"type": "string"}}}`, `{"pattern": 1}`, false},
+
+		{"code fence", `{"type": "object", "required": ["a"]}`, "```json\n{\"a\": 1}\n```", true},
+		{"bare code fence", `{"type": "object"}`, "  ```\n{}\n```  ", true},
+		{"text around json", `{"type": "object"}`, `Sure: {"a": 1}`, false},
+		{"two values", `{"type": "object"}`, `{} {}`, false},
+	}
+
+	for _, tc := range cases {
+		got, problems := validateResponse(tc.content, schemaFormat(tc.schema))
+		if valid := problems == nil; valid != tc.valid {
+			t.Errorf("%s: valid = %v, want %v (problems: %v)", tc.name, valid, tc.valid, problems)
+		}
+		if tc.valid && !json.Valid([]byte(got)) {
+			t.Errorf("%s: returned %q, which is not JSON", tc.name, got)
+		}
+	}
+}
+
+func TestValidateResponseCompactsAndStripsFence(t *testing.T) {
+	got, problems := validateResponse("```json\n{ \"a\" : [1, 2] }\n```", &models.ResponseFormat{Type: "json_object"})
+	if problems != nil || got != `{"a":[1,2]}` {
+		t.Fatalf("got %q, %v", got, problems)
+	}
+}
+
+func TestCheckResponseFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		valid  bool
+	}{
+		{"plain", `{"type": "object", "properties": {"name": {"type": "string"}}}`, true},
+		{"properties named like keywords", `{"properties": {"format": {"type": "string"}, "pattern": {"type": "string"}}}`, true},
+		{"ref", `{"properties": {"a": {"$ref": "#/$defs/a"}}, "$defs": {"a": {}}}`, false},
+		{"nested ref", `{"items": {"anyOf": [{"$ref": "#/definitions/a"}]}}`, false},
+		{"format", `{"properties": {"when": {"type": "string", "format": "date-time"}}}`, false},
+		{"bad pattern", `{"pattern": "("}`, false},
+		{"bad pattern under property named pattern", `{"properties": {"pattern": {"type": "string", "pattern": "("}}}`, false},
+		{"not an object", `[1]`, false},
+	}
+
+	for _, tc := range cases {
+		err := checkResponseFormat(schemaFormat(tc.schema))
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%s: valid = %v, want %v (%v)", tc.name, valid, tc.valid, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidResponseFormat) {
+			t.Errorf("%s: error %v is not ErrInvalidResponseFormat", tc.name, err)
+		}
+	}
+}
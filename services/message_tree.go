@@ -0,0 +1,244 @@
+package services
+
+import (
+	"kapi/models"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// Messages of a chat form a tree through ParentID. Messages sharing a parent
+// are siblings (alternative replies or edited prompts) and exactly one of them
+// is active. The conversation shown to the user and sent to the model is the
+// active path: the active root followed by the active child at every level.
+
+func (cs *ChatService) loadMessages(chatID uint) ([]models.Message, error) {
+	var messages []models.Message
+	if err := cs.db.Where("chat_id = ?", chatID).
+		Preload("Attachments").
+		Order("created_at ASC").
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// activePath follows the active child at each level starting from the roots.
+func activePath(messages []models.Message) []models.Message {
+	children := map[uint][]models.Message{}
+	var roots []models.Message
+	for _, msg := range messages {
+		if msg.ParentID == nil {
+			roots = append(roots, msg)
+		} else {
+			children[*msg.ParentID] = append(children[*msg.ParentID], msg)
+		}
+	}
+
+	var path []models.Message
+	level := roots
+	for {
+		next, ok := activeOf(level)
+		if !ok {
+			return path
+		}
+		path = append(path, next)
+		level = children[next.ID]
+	}
+}
+
+// activeOf picks the active message among siblings, falling back to the most
+// recent one if none is flagged.
+func activeOf(siblings []models.Message) (models.Message, bool) {
+	if len(siblings) == 0 {
+		return models.Message{}, false
+	}
+	for i := len(siblings) - 1; i >= 0; i-- {
+		if siblings[i].IsActive {
+			return siblings[i], true
+		}
+	}
+	return siblings[len(siblings)-1], true
+}
+
+// pathTo returns the messages from the root down to and including id.
+func pathTo(messages []models.Message, id uint) []models.Message {
+	byID := make(map[uint]models.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	var path []models.Message
+	for {
+		msg, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append([]models.Message{msg}, path...)
+		if msg.ParentID == nil {
+			break
+		}
+		id = *msg.ParentID
+	}
+	return path
+}
+
+// descendantIDs returns the ids of every message below id.
+func descendantIDs(messages []models.Message, id uint) []uint {
+	children := map[uint][]uint{}
+	for _, msg := range messages {
+		if msg.ParentID != nil {
+			children[*msg.ParentID] = append(children[*msg.ParentID], msg.ID)
+		}
+	}
+
+	var ids []uint
+	queue := children[id]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		ids = append(ids, next)
+		queue = append(queue, children[next]...)
+	}
+	return ids
+}
+
+func buildTree(messages []models.Message) []*models.MessageNode {
+	nodes := make(map[uint]*models.MessageNode, len(messages))
+	for _, msg := range messages {
+		nodes[msg.ID] = &models.MessageNode{Message: msg, Children: []*models.MessageNode{}}
+	}
+
+	roots := []*models.MessageNode{}
+	for _, msg := range messages {
+		node := nodes[msg.ID]
+		if msg.ParentID != nil {
+			if parent, ok := nodes[*msg.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// turnStart returns the first message of the assistant turn that message
+// belongs to. A reply that used tools starts with the assistant message that
+// called them, followed by the tool results; other messages start their own
+// turn.
+func (cs *ChatService) turnStart(message *models.Message) (*models.Message, error) {
+	start := message
+	for start.ParentID != nil {
+		var parent models.Message
+		if err := cs.db.Where("id = ? AND chat_id = ?", *start.ParentID, start.ChatID).
+			First(&parent).Error; err != nil {
+			return nil, err
+		}
+		if parent.Role != "tool" && len(parent.ToolCalls) == 0 {
+			break
+		}
+		start = &parent
+	}
+	return start, nil
+}
+
+// activeLeaf returns the last message of the chat's active path.
+func (cs *ChatService) activeLeaf(chatID uint) (*models.Message, error) {
+	messages, err := cs.loadMessages(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	path := activePath(messages)
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return &path[len(path)-1], nil
+}
+
+func (cs *ChatService) siblings(message *models.Message) *gorm.DB {
+	query := cs.db.Model(&models.Message{}).
+		Where("chat_id = ? AND id <> ?", message.ChatID, message.ID)
+	if message.ParentID == nil {
+		return query.Where("parent_id IS NULL")
+	}
+	return query.Where("parent_id = ?", *message.ParentID)
+}
+
+func (cs *ChatService) deactivateSiblings(message *models.Message) {
+	if err := cs.siblings(message).Update("is_active", false).Error; err != nil {
+		log.Printf("Failed to deactivate siblings of message %d: %v", message.ID, err)
+	}
+}
+
+// activateLatestSibling restores an active sibling after the active message
+// was removed.
+func (cs *ChatService) activateLatestSibling(message *models.Message) {
+	if !message.IsActive {
+		return
+	}
+
+	var sibling models.Message
+	if err := cs.siblings(message).
+		Order("created_at DESC").
+		First(&sibling).Error; err != nil {
+		return
+	}
+
+	cs.db.Model(&sibling).Update("is_active", true)
+}
+
+// activatePath makes the branch leading to message the active path.
+func (cs *ChatService) activatePath(message *models.Message) error {
+	messages, err := cs.loadMessages(message.ChatID)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range pathTo(messages, message.ID) {
+		if err := cs.db.Model(&msg).Update("is_active", true).Error; err != nil {
+			return err
+		}
+		cs.deactivateSiblings(&msg)
+	}
+
+	message.IsActive = true
+	return nil
+}
+
+// BackfillMessageTree links the messages of chats created before branching
+// existed into a single path, in creation order.
+func BackfillMessageTree(db *gorm.DB) error {
+	var chats []models.Chat
+	if err := db.Where("message_tree = ?", false).Find(&chats).Error; err != nil {
+		return err
+	}
+
+	for _, chat := range chats {
+		var messages []models.Message
+		if err := db.Where("chat_id = ?", chat.ID).
+			Order("created_at ASC").
+			Find(&messages).Error; err != nil {
+			return err
+		}
+
+		var leaf *models.Message
+		for i := range messages {
+			msg := &messages[i]
+			if msg.ParentID == nil && leaf != nil {
+				if err := db.Model(msg).UpdateColumn("parent_id", leaf.ID).Error; err != nil {
+					return err
+				}
+			}
+			if msg.IsActive || leaf == nil {
+				leaf = msg
+			}
+		}
+
+		if err := db.Model(&chat).UpdateColumn("message_tree", true).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
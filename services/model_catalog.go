@@ -0,0 +1,306 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kapi/config"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrModelNotAllowed = errors.New("model is not available on this server")
+
+// catalogRetryInterval is the minimum time between refreshes triggered by
+// lookups, so that an unreachable provider is not asked on every request.
+const catalogRetryInterval = time.Minute
+
+// ModelCatalog caches the models offered by the registered providers, or by
+// a local catalog file, and applies the operator's allow and deny lists.
+// Refreshing the catalog also updates the price table and context sizes.
+type ModelCatalog struct {
+	providers    *ProviderRegistry
+	prices       *PriceTable
+	sizes        *ContextSizes
+	cfg          config.CatalogConfig
+	apiKey       string
+	defaultModel string
+
+	mu         sync.Mutex
+	models     []ModelInfo
+	fetchedAt  time.Time
+	triedAt    time.Time
+	refreshing bool
+}
+
+// NewModelCatalog creates a catalog. apiKey is the server's OpenRouter key,
+// used for listing models of providers that require one.
+func NewModelCatalog(providers *ProviderRegistry, prices *PriceTable, sizes *ContextSizes, cfg config.CatalogConfig, apiKey, defaultModel string) *ModelCatalog {
+	return &ModelCatalog{
+		providers:    providers,
+		prices:       prices,
+		sizes:        sizes,
+		cfg:          cfg,
+		apiKey:       apiKey,
+		defaultModel: defaultModel,
+	}
+}
+
+// DefaultModel is used when neither the request nor the chat names a model.
+func (c *ModelCatalog) DefaultModel() string {
+	return c.defaultModel
+}
+
+// Models returns the allowed models, refreshing the cache once it is older
+// than the configured TTL. A stale catalog is served if a refresh fails.
+func (c *ModelCatalog) Models(ctx context.Context) ([]ModelInfo, error) {
+	c.mu.Lock()
+	stale := c.models == nil || time.Since(c.fetchedAt) > c.cfg.TTL
+	c.mu.Unlock()
+
+	if stale {
+		if err := c.Refresh(ctx); err != nil {
+			c.mu.Lock()
+			empty := c.models == nil
+			c.mu.Unlock()
+			if empty {
+				return nil, err
+			}
+			log.Printf("Failed to refresh model catalog, serving cached copy: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	models := make([]ModelInfo, 0, len(c.models))
+	for _, m := range c.models {
+		if c.Allowed(m.ID) {
+			models = append(models, m)
+		}
+	}
+	return models, nil
+}
+
+// Lookup returns the catalog entry for a model, if it has been loaded. A
+// missing model or an expired catalog starts a refresh in the background, so
+// that a catalog that failed to load recovers without a restart.
+func (c *ModelCatalog) Lookup(model string) (ModelInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.models {
+		if m.ID == model {
+			if c.cfg.TTL > 0 && time.Since(c.fetchedAt) > c.cfg.TTL {
+				c.refreshLater()
+			}
+			return m, true
+		}
+	}
+	c.refreshLater()
+	return ModelInfo{}, false
+}
+
+// refreshLater refreshes the catalog in the background unless a refresh is
+// running or was tried within catalogRetryInterval. The caller holds c.mu.
+func (c *ModelCatalog) refreshLater() {
+	if c.refreshing || time.Since(c.triedAt) < catalogRetryInterval {
+		return
+	}
+	c.refreshing = true
+	c.triedAt = time.Now()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := c.Refresh(ctx); err != nil {
+			log.Printf("Failed to refresh model catalog: %v", err)
+		}
+		c.mu.Lock()
+		c.refreshing = false
+		c.mu.Unlock()
+	}()
+}
+
+// SupportsInput reports whether the model accepts modality ("image",
+// "file"). Models missing from the catalog are given the benefit of the
+// doubt: the provider rejects what it cannot handle.
+func (c *ModelCatalog) SupportsInput(model, modality string) bool {
+	model, _, _ = strings.Cut(model, "?")
+	info, ok := c.Lookup(model)
+	if !ok {
+		return true
+	}
+	for _, m := range info.InputModalities {
+		if m == modality {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsTools reports whether the model can call functions. Models
+// missing from the catalog are offered tools too.
+func (c *ModelCatalog) SupportsTools(model string) bool {
+	model, _, _ = strings.Cut(model, "?")
+	info, ok := c.Lookup(model)
+	return !ok || info.SupportsTools
+}
+
+// SupportsResponseFormat reports whether the model enforces a JSON Schema
+// response_format itself. For models missing from the catalog it is false,
+// which is safe either way: the schema is also given in the prompt and the
+// reply is validated.
+func (c *ModelCatalog) SupportsResponseFormat(model string) bool {
+	model, _, _ = strings.Cut(model, "?")
+	info, ok := c.Lookup(model)
+	return ok && info.SupportsResponseFormat
+}
+
+// Refresh reloads the catalog from the catalog file or the providers.
+func (c *ModelCatalog) Refresh(ctx context.Context) error {
+	var models []ModelInfo
+	var err error
+	if c.cfg.File != "" {
+		models, err = c.loadFile()
+	} else {
+		models, err = c.fetch(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+
+	prices := map[string]ModelPrice{}
+	sizes := map[string]int{}
+	for _, m := range models {
+		if m.Pricing != nil {
+			prices[m.ID] = *m.Pricing
+		}
+		if m.ContextLength > 0 {
+			sizes[m.ID] = m.ContextLength
+		}
+	}
+	c.prices.Set(prices)
+	c.sizes.Set(sizes)
+
+	c.mu.Lock()
+	c.models = models
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *ModelCatalog) loadFile() ([]ModelInfo, error) {
+	data, err := os.ReadFile(c.cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model catalog file %s: %v", c.cfg.File, err)
+	}
+
+	var models []ModelInfo
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("failed to parse model catalog file %s: %v", c.cfg.File, err)
+	}
+	return models, nil
+}
+
+// fetch lists models from every provider. Providers that fail are skipped so
+// that one unreachable backend does not empty the catalog.
+func (c *ModelCatalog) fetch(ctx context.Context) ([]ModelInfo, error) {
+	var models []ModelInfo
+	var errs []error
+	for _, provider := range c.providers.All() {
+		key := ""
+		if provider.RequiresUserKey() {
+			key = c.apiKey
+		}
+
+		listed, err := provider.ListModels(ctx, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", provider.Name(), err))
+			continue
+		}
+		models = append(models, listed...)
+	}
+
+	if len(models) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("Failed to list models: %v", err)
+	}
+	return models, nil
+}
+
+// Allowed reports whether the operator's lists permit a model. Options
+// appended to the model string ("fake:echo?chunk=2") are ignored. The model
+// is matched under the name the catalog lists it by, so that adding or
+// dropping a provider prefix does not get around the lists; the deny list
+// also matches the bare model id.
+func (c *ModelCatalog) Allowed(model string) bool {
+	model, _, _ = strings.Cut(model, "?")
+	canonical, modelID := model, model
+	if provider, id, err := c.providers.Resolve(model); err == nil {
+		modelID = id
+		canonical = id
+		if provider.Name() != defaultProviderName {
+			canonical = provider.Name() + ":" + id
+		}
+	}
+
+	for _, name := range []string{model, canonical, modelID} {
+		if matchesAny(c.cfg.Deny, name) {
+			return false
+		}
+	}
+	return len(c.cfg.Allow) == 0 || matchesAny(c.cfg.Allow, canonical)
+}
+
+// Check returns ErrModelNotAllowed for models excluded by the operator.
+func (c *ModelCatalog) Check(model string) error {
+	if !c.Allowed(model) {
+		return fmt.Errorf("%w: %s", ErrModelNotAllowed, model)
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether name matches pattern, where "*" stands for any
+// run of characters, including "/", and "?" for exactly one.
+func matchGlob(pattern, name string) bool {
+	// Backtrack to the last star when the rest fails to match.
+	p, n := 0, 0
+	star, next := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, n
+			p++
+		case star >= 0:
+			next++
+			p, n = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kapi/config"
+)
+
+func TestAllowedCannotBeBypassedWithProviderPrefix(t *testing.T) {
+	registry := NewProviderRegistry(&config.Config{
+		OpenRouterBaseURL:         "http://openrouter.invalid",
+		OpenAICompatibleProviders: []config.ProviderConfig{{Name: "local", BaseURL: "http://local.invalid"}},
+		FakeLLM:                   config.FakeLLMConfig{Enabled: true},
+	})
+
+	deny := NewModelCatalog(registry, nil, nil, config.CatalogConfig{Deny: []string{"openai/*"}}, "", "")
+	for _, model := range []string{"openai/gpt-4o", "openrouter:openai/gpt-4o", "local:openai/gpt-4o"} {
+		if deny.Allowed(model) {
+			t.Errorf("%s should be denied", model)
+		}
+	}
+	if !deny.Allowed("anthropic/claude-3.5-haiku") {
+		t.Error("anthropic/claude-3.5-haiku should be allowed")
+	}
+
+	allow := NewModelCatalog(registry, nil, nil, config.CatalogConfig{Allow: []string{"openai/*", "fake:*"}}, "", "")
+	cases := map[string]bool{
+		"openai/gpt-4o":            true,
+		"openrouter:openai/gpt-4o": true,
+		"fake:echo?chunk=2":        true,
+		// Another provider serving a model of the same name is not allowed.
+		"local:openai/gpt-4o": false,
+	}
+	for model, want := range cases {
+		if got := allow.Allowed(model); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestPatternsMatchVendorPrefixedIDs(t *testing.T) {
+	cases := []struct {
+		pattern string
+		model   string
+		want    bool
+	}{
+		{"*", "openai/gpt-4o", true},
+		{"*gpt*", "openai/gpt-4o", true},
+		{"*free*", "meta-llama/llama-3.1-8b-instruct:free", true},
+		{"*:free", "meta-llama/llama-3.1-8b-instruct:free", true},
+		{"openai/*", "openai/gpt-4o", true},
+		{"openai/gpt-4?", "openai/gpt-4o", true},
+		{"openai/gpt-4o", "openai/gpt-4o", true},
+		{"*claude*", "openai/gpt-4o", false},
+		{"openai/*", "anthropic/openai", false},
+		{"gpt*", "openai/gpt-4o", false},
+		{"openai/gpt-4?", "openai/gpt-4", false},
+	}
+	for _, tc := range cases {
+		if got := matchesAny([]string{tc.pattern}, tc.model); got != tc.want {
+			t.Errorf("%q matching %q = %v, want %v", tc.pattern, tc.model, got, tc.want)
+		}
+	}
+}
+
+func TestUnknownModelsAreNotTreatedAsUnsupported(t *testing.T) {
+	catalog := NewModelCatalog(nil, LoadPriceTable(""), NewContextSizes(0),
+		config.CatalogConfig{File: filepath.Join(t.TempDir(), "missing.json")}, "", "")
+
+	if !catalog.SupportsInput("vendor/unknown", "image") || !catalog.SupportsTools("vendor/unknown") {
+		t.Error("unknown models should be assumed to accept attachments and tools")
+	}
+	if catalog.SupportsResponseFormat("vendor/unknown") {
+		t.Error("unknown models should get the response format in the prompt")
+	}
+}
+
+func TestLookupRecoversFromFailedLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.json")
+	catalog := NewModelCatalog(nil, LoadPriceTable(""), NewContextSizes(0), config.CatalogConfig{File: file}, "", "")
+	if err := catalog.Refresh(context.Background()); err == nil {
+		t.Fatal("expected loading a missing file to fail")
+	}
+
+	if err := os.WriteFile(file, []byte(`[{"id": "ollama:llava", "input_modalities": ["text"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := catalog.Lookup("ollama:llava"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("catalog was not reloaded after a miss")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if catalog.SupportsInput("ollama:llava", "image") {
+		t.Error("listed modalities should apply once the model is known")
+	}
+}
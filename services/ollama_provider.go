@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kapi/models"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const ollamaProviderName = "ollama"
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+	// Thinking is streamed by reasoning models; it is never sent back.
+	Thinking string `json:"thinking,omitempty"`
+}
+
+// ollamaToolCall carries arguments as a JSON object rather than a string.
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Options  *ollamaOptions  `json:"options,omitempty"`
+	// Tools use the same schema as the OpenAI API.
+	Tools []ChatCompletionTool `json:"tools,omitempty"`
+	// Format is "json" or a JSON Schema the reply must follow.
+	Format json.RawMessage `json:"format,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type ollamaChatChunk struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+	EvalCount       int           `json:"eval_count,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// OllamaProvider talks to a local Ollama server using its native /api/chat
+// endpoint, which streams newline-delimited JSON instead of SSE.
+type OllamaProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewOllamaProvider(baseURL string, client *http.Client) *OllamaProvider {
+	return &OllamaProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+	}
+}
+
+func (p *OllamaProvider) Name() string {
+	return ollamaProviderName
+}
+
+func (p *OllamaProvider) RequiresUserKey() bool {
+	return false
+}
+
+func (p *OllamaProvider) StreamChat(ctx context.Context, apiKey string, req *CompletionRequest, onDelta func(StreamDelta)) (*CompletionResult, error) {
+	body := ollamaChatRequest{
+		Model:  req.Model,
+		Stream: true,
+	}
+	if req.Temperature != nil || req.TopP != nil || req.MaxTokens != nil || len(req.Stop) > 0 {
+		body.Options = &ollamaOptions{
+			Temperature: req.Temperature,
+			TopP:        req.TopP,
+			NumPredict:  req.MaxTokens,
+			Stop:        req.Stop,
+		}
+	}
+	for _, msg := range req.Messages {
+		var images []string
+		for _, part := range msg.Parts {
+			if part.Type == "image" {
+				images = append(images, base64.StdEncoding.EncodeToString(part.Data))
+			}
+		}
+		message := ollamaMessage{
+			Role:     msg.Role,
+			Content:  msg.Content,
+			Images:   images,
+			ToolName: msg.ToolName,
+		}
+		for _, call := range msg.ToolCalls {
+			var toolCall ollamaToolCall
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = json.RawMessage(call.Arguments)
+			if !json.Valid(toolCall.Function.Arguments) {
+				toolCall.Function.Arguments = json.RawMessage("{}")
+			}
+			message.ToolCalls = append(message.ToolCalls, toolCall)
+		}
+		body.Messages = append(body.Messages, message)
+	}
+	if format := req.ResponseFormat; format != nil {
+		if format.JSONSchema != nil {
+			body.Format = format.JSONSchema.Schema
+		} else {
+			body.Format = json.RawMessage(`"json"`)
+		}
+	}
+	for _, tool := range req.Tools {
+		body.Tools = append(body.Tools, ChatCompletionTool{
+			Type: "function",
+			Function: ChatCompletionFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.apiError(resp)
+	}
+
+	result := &CompletionResult{Model: req.Model}
+	scanner := bufio.NewScanner(resp.Body)
+	// A stream that stops before the chunk with done set was cut off.
+	finished := false
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var chunk ollamaChatChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			log.Printf("Error unmarshalling Ollama stream data: %v, data: %s", err, line)
+			continue
+		}
+
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("Ollama error: %s", chunk.Error)
+		}
+
+		if chunk.Message.Content != "" || chunk.Message.Thinking != "" {
+			onDelta(StreamDelta{Content: chunk.Message.Content, Reasoning: chunk.Message.Thinking})
+		}
+		// Ollama sends complete tool calls without ids.
+		for _, call := range chunk.Message.ToolCalls {
+			result.ToolCalls = append(result.ToolCalls, models.ToolCall{
+				ID:        fmt.Sprintf("call_%d", len(result.ToolCalls)),
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			})
+		}
+
+		if chunk.Done {
+			result.FinishReason = chunk.DoneReason
+			result.Usage = TokenUsage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+				TotalTokens:      chunk.PromptEvalCount + chunk.EvalCount,
+			}
+			finished = true
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !finished {
+		return nil, fmt.Errorf("Ollama stream ended before the response was complete: %w", io.ErrUnexpectedEOF)
+	}
+
+	return result, nil
+}
+
+func (p *OllamaProvider) ListModels(ctx context.Context, apiKey string) ([]ModelInfo, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.apiError(resp)
+	}
+
+	var payload struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(payload.Models))
+	for _, m := range payload.Models {
+		models = append(models, ModelInfo{
+			ID:       ollamaProviderName + ":" + m.Name,
+			Name:     m.Name,
+			Provider: ollamaProviderName,
+			// Ollama constrains any model's output through "format".
+			SupportsResponseFormat: true,
+		})
+	}
+	return models, nil
+}
+
+// ValidateKey only checks that the server is reachable; Ollama has no keys.
+func (p *OllamaProvider) ValidateKey(ctx context.Context, apiKey string) error {
+	_, err := p.ListModels(ctx, apiKey)
+	return err
+}
+
+func (p *OllamaProvider) apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	return &ProviderError{
+		Provider:   ollamaProviderName,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func streamOllama(t *testing.T, body string) (string, error) {
+	t.Helper()
+	server := streamServer(body)
+	defer server.Close()
+
+	provider := NewOllamaProvider(server.URL, server.Client())
+	var content string
+	_, err := provider.StreamChat(context.Background(), "", &CompletionRequest{Model: "m"}, func(delta StreamDelta) {
+		content += delta.Content
+	})
+	return content, err
+}
+
+func TestOllamaStreamComplete(t *testing.T) {
+	content, err := streamOllama(t, "{\"message\":{\"content\":\"hi\"}}\n{\"done\":true,\"done_reason\":\"stop\"}\n")
+	if err != nil || content != "hi" {
+		t.Fatalf("unexpected result %q, %v", content, err)
+	}
+}
+
+func TestOllamaStreamTruncated(t *testing.T) {
+	content, err := streamOllama(t, "{\"message\":{\"content\":\"hi\"}}\n")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a truncated stream error, got %v", err)
+	}
+	if content != "hi" {
+		t.Fatalf("expected the partial content to be streamed, got %q", content)
+	}
+}
@@ -0,0 +1,470 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kapi/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ChatCompletionMessage.Content is a string, or a list of content parts for
+// messages with attachments.
+type ChatCompletionMessage struct {
+	Role       string                   `json:"role"`
+	Content    interface{}              `json:"content"`
+	ToolCalls  []ChatCompletionToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string                   `json:"tool_call_id,omitempty"`
+}
+
+type ChatCompletionTool struct {
+	Type     string                 `json:"type"`
+	Function ChatCompletionFunction `json:"function"`
+}
+
+type ChatCompletionFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type ChatCompletionToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type contentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *imageURLPart `json:"image_url,omitempty"`
+	File     *filePart     `json:"file,omitempty"`
+}
+
+type imageURLPart struct {
+	URL string `json:"url"`
+}
+
+type filePart struct {
+	FileName string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
+type ChatCompletionRequest struct {
+	Model           string                  `json:"model"`
+	Messages        []ChatCompletionMessage `json:"messages"`
+	Stream          bool                    `json:"stream"`
+	StreamOptions   *StreamOptions          `json:"stream_options,omitempty"`
+	Usage           *UsageOptions           `json:"usage,omitempty"`
+	Temperature     *float64                `json:"temperature,omitempty"`
+	TopP            *float64                `json:"top_p,omitempty"`
+	MaxTokens       *int                    `json:"max_tokens,omitempty"`
+	Stop            []string                `json:"stop,omitempty"`
+	ReasoningEffort string                  `json:"reasoning_effort,omitempty"`
+	Reasoning       *ReasoningOptions       `json:"reasoning,omitempty"`
+	Tools           []ChatCompletionTool    `json:"tools,omitempty"`
+	ResponseFormat  *models.ResponseFormat  `json:"response_format,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// UsageOptions is OpenRouter's extension for requesting token accounting.
+type UsageOptions struct {
+	Include bool `json:"include"`
+}
+
+// ReasoningOptions is OpenRouter's unified reasoning configuration.
+type ReasoningOptions struct {
+	Effort string `json:"effort,omitempty"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens            int     `json:"prompt_tokens"`
+	CompletionTokens        int     `json:"completion_tokens"`
+	TotalTokens             int     `json:"total_tokens"`
+	Cost                    float64 `json:"cost,omitempty"`
+	CompletionTokensDetails *struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details,omitempty"`
+}
+
+type ChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role      string `json:"role,omitempty"`
+			Content   string `json:"content,omitempty"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id,omitempty"`
+				Function struct {
+					Name      string `json:"name,omitempty"`
+					Arguments string `json:"arguments,omitempty"`
+				} `json:"function"`
+			} `json:"tool_calls,omitempty"`
+			// Reasoning is sent by OpenRouter, ReasoningContent by
+			// DeepSeek and vLLM style servers.
+			Reasoning        string `json:"reasoning,omitempty"`
+			ReasoningContent string `json:"reasoning_content,omitempty"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *ChatCompletionUsage `json:"usage,omitempty"`
+}
+
+// OpenAICompatibleProvider talks to any server implementing the OpenAI
+// /chat/completions and /models endpoints.
+type OpenAICompatibleProvider struct {
+	name    string
+	baseURL string
+	apiKey  string
+	headers map[string]string
+	client  *http.Client
+	// usageExtension sends OpenRouter's "usage" option instead of the
+	// standard stream_options.
+	usageExtension bool
+}
+
+func NewOpenAICompatibleProvider(name, baseURL, apiKey string, client *http.Client) *OpenAICompatibleProvider {
+	return &OpenAICompatibleProvider{
+		name:    name,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		headers: map[string]string{},
+		client:  client,
+	}
+}
+
+func (p *OpenAICompatibleProvider) Name() string {
+	return p.name
+}
+
+func (p *OpenAICompatibleProvider) RequiresUserKey() bool {
+	return false
+}
+
+func (p *OpenAICompatibleProvider) StreamChat(ctx context.Context, apiKey string, req *CompletionRequest, onDelta func(StreamDelta)) (*CompletionResult, error) {
+	body := ChatCompletionRequest{
+		Model:       req.Model,
+		Stream:      true,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxTokens,
+		Stop:        req.Stop,
+	}
+	if p.usageExtension {
+		body.Usage = &UsageOptions{Include: true}
+		if req.ReasoningEffort != "" {
+			body.Reasoning = &ReasoningOptions{Effort: req.ReasoningEffort}
+		}
+	} else {
+		body.StreamOptions = &StreamOptions{IncludeUsage: true}
+		body.ReasoningEffort = req.ReasoningEffort
+	}
+	if format := req.ResponseFormat; format != nil {
+		body.ResponseFormat = format
+		if format.JSONSchema != nil && format.JSONSchema.Name == "" {
+			// The schema name is required by the OpenAI API.
+			schema := *format.JSONSchema
+			schema.Name = "response"
+			body.ResponseFormat = &models.ResponseFormat{Type: format.Type, JSONSchema: &schema}
+		}
+	}
+	for _, tool := range req.Tools {
+		body.Tools = append(body.Tools, ChatCompletionTool{
+			Type: "function",
+			Function: ChatCompletionFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	for _, msg := range req.Messages {
+		message := ChatCompletionMessage{
+			Role:       msg.Role,
+			Content:    openAIContent(msg),
+			ToolCallID: msg.ToolCallID,
+		}
+		for _, call := range msg.ToolCalls {
+			toolCall := ChatCompletionToolCall{ID: call.ID, Type: "function"}
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = call.Arguments
+			message.ToolCalls = append(message.ToolCalls, toolCall)
+		}
+		body.Messages = append(body.Messages, message)
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := p.newRequest(ctx, "POST", "/chat/completions", apiKey, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.apiError(resp)
+	}
+
+	result := &CompletionResult{Model: req.Model}
+	scanner := bufio.NewScanner(resp.Body)
+	// Tool calls arrive in fragments keyed by index: the first carries the
+	// id and name, later ones append to the arguments.
+	var toolCalls []*models.ToolCall
+	// A stream that stops without [DONE] or a finish reason was cut off.
+	finished := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		data := strings.TrimPrefix(line, "data: ")
+
+		if data == "[DONE]" {
+			finished = true
+			break
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Printf("Error unmarshalling %s stream data: %v, data: %s", p.name, err, data)
+			continue
+		}
+
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.ID != "" {
+			result.GenerationID = chunk.ID
+		}
+		if chunk.Usage != nil {
+			result.Usage = TokenUsage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+				TotalTokens:      chunk.Usage.TotalTokens,
+				Cost:             chunk.Usage.Cost,
+			}
+			if chunk.Usage.CompletionTokensDetails != nil {
+				result.Usage.ReasoningTokens = chunk.Usage.CompletionTokensDetails.ReasoningTokens
+			}
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			result.FinishReason = *choice.FinishReason
+			finished = true
+		}
+		reasoning := choice.Delta.Reasoning
+		if reasoning == "" {
+			reasoning = choice.Delta.ReasoningContent
+		}
+		if choice.Delta.Content != "" || reasoning != "" {
+			onDelta(StreamDelta{Content: choice.Delta.Content, Reasoning: reasoning})
+		}
+		for _, fragment := range choice.Delta.ToolCalls {
+			for len(toolCalls) <= fragment.Index {
+				toolCalls = append(toolCalls, &models.ToolCall{})
+			}
+			call := toolCalls[fragment.Index]
+			if fragment.ID != "" {
+				call.ID = fragment.ID
+			}
+			call.Name += fragment.Function.Name
+			call.Arguments += fragment.Function.Arguments
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !finished {
+		return nil, fmt.Errorf("%s stream ended before the response was complete: %w", p.name, io.ErrUnexpectedEOF)
+	}
+
+	for _, call := range toolCalls {
+		if call.Name != "" {
+			result.ToolCalls = append(result.ToolCalls, *call)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *OpenAICompatibleProvider) ListModels(ctx context.Context, apiKey string) ([]ModelInfo, error) {
+	httpReq, err := p.newRequest(ctx, "GET", "/models", apiKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.apiError(resp)
+	}
+
+	// Pricing, architecture and supported parameters are OpenRouter
+	// extensions; plain OpenAI-compatible servers only return ids.
+	var payload struct {
+		Data []struct {
+			ID            string `json:"id"`
+			Name          string `json:"name"`
+			ContextLength int    `json:"context_length"`
+			Pricing       *struct {
+				Prompt     string `json:"prompt"`
+				Completion string `json:"completion"`
+			} `json:"pricing"`
+			Architecture *struct {
+				InputModalities []string `json:"input_modalities"`
+			} `json:"architecture"`
+			SupportedParameters []string `json:"supported_parameters"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(payload.Data))
+	for _, m := range payload.Data {
+		name := m.Name
+		if name == "" {
+			name = m.ID
+		}
+		info := ModelInfo{
+			ID:            p.qualify(m.ID),
+			Name:          name,
+			Provider:      p.name,
+			ContextLength: m.ContextLength,
+		}
+		if m.Pricing != nil {
+			// Prices are quoted in USD per token.
+			prompt, errPrompt := strconv.ParseFloat(m.Pricing.Prompt, 64)
+			completion, errCompletion := strconv.ParseFloat(m.Pricing.Completion, 64)
+			if errPrompt == nil && errCompletion == nil {
+				info.Pricing = &ModelPrice{Prompt: prompt * 1_000_000, Completion: completion * 1_000_000}
+			}
+		}
+		if m.Architecture != nil {
+			info.InputModalities = m.Architecture.InputModalities
+		}
+		for _, param := range m.SupportedParameters {
+			switch param {
+			case "tools":
+				info.SupportsTools = true
+			case "response_format", "structured_outputs":
+				info.SupportsResponseFormat = true
+			}
+		}
+		models = append(models, info)
+	}
+	return models, nil
+}
+
+func (p *OpenAICompatibleProvider) ValidateKey(ctx context.Context, apiKey string) error {
+	_, err := p.ListModels(ctx, apiKey)
+	return err
+}
+
+// qualify prefixes a model id with the provider name so that it resolves back
+// to this provider when sent in a chat request.
+func (p *OpenAICompatibleProvider) qualify(modelID string) string {
+	if p.name == defaultProviderName {
+		return modelID
+	}
+	return p.name + ":" + modelID
+}
+
+func (p *OpenAICompatibleProvider) newRequest(ctx context.Context, method, path, apiKey string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if apiKey == "" {
+		apiKey = p.apiKey
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (p *OpenAICompatibleProvider) apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	return &ProviderError{
+		Provider:   p.name,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+}
+
+// ProviderError is returned when an upstream LLM API answers with a non-200
+// status.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s API error (Status: %d): %s", e.Provider, e.StatusCode, e.Body)
+}
+
+func openAIContent(msg CompletionMessage) interface{} {
+	if len(msg.Parts) == 0 {
+		return msg.Content
+	}
+
+	parts := make([]contentPart, 0, len(msg.Parts)+1)
+	if msg.Content != "" {
+		parts = append(parts, contentPart{Type: "text", Text: msg.Content})
+	}
+	for _, part := range msg.Parts {
+		switch part.Type {
+		case "image":
+			parts = append(parts, contentPart{Type: "image_url", ImageURL: &imageURLPart{URL: part.dataURL()}})
+		case "file":
+			parts = append(parts, contentPart{Type: "file", File: &filePart{FileName: part.FileName, FileData: part.dataURL()}})
+		}
+	}
+	return parts
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// streamServer answers every request with body as a stream.
+func streamServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func streamOpenAI(t *testing.T, body string) (string, *CompletionResult, error) {
+	t.Helper()
+	server := streamServer(body)
+	defer server.Close()
+
+	provider := NewOpenAICompatibleProvider("test", server.URL, "key", server.Client())
+	var content string
+	result, err := provider.StreamChat(context.Background(), "", &CompletionRequest{Model: "m"}, func(delta StreamDelta) {
+		content += delta.Content
+	})
+	return content, result, err
+}
+
+func TestOpenAIStreamComplete(t *testing.T) {
+	for _, body := range []string{
+		"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n",
+		"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"},\"finish_reason\":\"stop\"}]}\n\n",
+	} {
+		content, result, err := streamOpenAI(t, body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if content != "hi" || result == nil {
+			t.Fatalf("unexpected result %q, %+v", content, result)
+		}
+	}
+}
+
+func TestOpenAIStreamTruncated(t *testing.T) {
+	content, _, err := streamOpenAI(t, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a truncated stream error, got %v", err)
+	}
+	if content != "hi" {
+		t.Fatalf("expected the partial content to be streamed, got %q", content)
+	}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"net/http"
+)
+
+// OpenRouterProvider is the default provider. It speaks the OpenAI wire format
+// but authenticates with the user's own OpenRouter key.
+type OpenRouterProvider struct {
+	*OpenAICompatibleProvider
+}
+
+func NewOpenRouterProvider(baseURL string, client *http.Client) *OpenRouterProvider {
+	p := NewOpenAICompatibleProvider(defaultProviderName, baseURL, "", client)
+	p.headers["HTTP-Referer"] = "http://localhost:8080" // Adjust as per your actual referer
+	p.headers["X-Title"] = "Kapi"
+	p.usageExtension = true
+	return &OpenRouterProvider{OpenAICompatibleProvider: p}
+}
+
+func (p *OpenRouterProvider) RequiresUserKey() bool {
+	return true
+}
+
+// ValidateKey checks the key against OpenRouter's key endpoint, since the
+// model list is public and would accept any key.
+func (p *OpenRouterProvider) ValidateKey(ctx context.Context, apiKey string) error {
+	req, err := p.newRequest(ctx, "GET", "/key", apiKey, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return p.apiError(resp)
+	}
+	return nil
+}
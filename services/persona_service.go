@@ -0,0 +1,181 @@
+package services
+
+import (
+	"errors"
+	"kapi/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type PersonaService struct {
+	db *gorm.DB
+}
+
+func NewPersonaService(db *gorm.DB) *PersonaService {
+	return &PersonaService{db: db}
+}
+
+func (ps *PersonaService) ListPersonas(userID uint) ([]models.Persona, error) {
+	var personas []models.Persona
+	if err := ps.db.Where("user_id = ?", userID).
+		Order("name ASC").
+		Find(&personas).Error; err != nil {
+		return nil, err
+	}
+	return personas, nil
+}
+
+func (ps *PersonaService) GetPersona(personaID, userID uint) (*models.Persona, error) {
+	var persona models.Persona
+	if err := ps.db.Where("id = ? AND user_id = ?", personaID, userID).
+		First(&persona).Error; err != nil {
+		return nil, errors.New("persona not found")
+	}
+	return &persona, nil
+}
+
+// GetDefaultPersona returns the user's default persona, or nil if none is set.
+func (ps *PersonaService) GetDefaultPersona(userID uint) (*models.Persona, error) {
+	var persona models.Persona
+	err := ps.db.Where("user_id = ? AND is_default = ?", userID, true).
+		First(&persona).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persona, nil
+}
+
+func (ps *PersonaService) CreatePersona(userID uint, req *models.CreatePersonaRequest) (*models.Persona, error) {
+	persona := &models.Persona{
+		UserID:    userID,
+		Name:      req.Name,
+		IsDefault: req.IsDefault,
+	}
+	persona.Settings.Apply(&req.ChatSettingsRequest)
+
+	err := ps.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(persona).Error; err != nil {
+			return err
+		}
+		if persona.IsDefault {
+			return clearOtherDefaults(tx, persona)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return persona, nil
+}
+
+func (ps *PersonaService) UpdatePersona(personaID, userID uint, req *models.UpdatePersonaRequest) (*models.Persona, error) {
+	persona, err := ps.GetPersona(personaID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := persona.Settings.Apply(&req.ChatSettingsRequest)
+	if req.Name != "" {
+		persona.Name = req.Name
+		columns = append(columns, "name")
+	}
+	if req.IsDefault != nil {
+		persona.IsDefault = *req.IsDefault
+		columns = append(columns, "is_default")
+	}
+
+	if len(columns) == 0 {
+		return persona, nil
+	}
+
+	err = ps.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(persona).Select(append(columns, "updated_at")).Updates(persona).Error; err != nil {
+			return err
+		}
+		if persona.IsDefault {
+			return clearOtherDefaults(tx, persona)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return persona, nil
+}
+
+func (ps *PersonaService) DeletePersona(personaID, userID uint) error {
+	result := ps.db.Where("id = ? AND user_id = ?", personaID, userID).
+		Delete(&models.Persona{})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("persona not found")
+	}
+
+	return nil
+}
+
+// clearOtherDefaults keeps at most one default persona per user.
+func clearOtherDefaults(tx *gorm.DB, persona *models.Persona) error {
+	return tx.Model(&models.Persona{}).
+		Where("user_id = ? AND id <> ?", persona.UserID, persona.ID).
+		Update("is_default", false).Error
+}
+
+// mergeSettings layers chat settings over persona settings: the chat's own
+// values win, and system prompts are combined with the user's custom
+// instructions first.
+func mergeSettings(instructions string, persona *models.Persona, chat models.ChatSettings) models.ChatSettings {
+	var prompts []string
+	if instructions != "" {
+		prompts = append(prompts, instructions)
+	}
+
+	merged := chat
+	if persona != nil {
+		base := persona.Settings
+		if base.SystemPrompt != "" {
+			prompts = append(prompts, base.SystemPrompt)
+		}
+		if merged.DefaultModel == "" {
+			merged.DefaultModel = base.DefaultModel
+		}
+		if merged.Temperature == nil {
+			merged.Temperature = base.Temperature
+		}
+		if merged.TopP == nil {
+			merged.TopP = base.TopP
+		}
+		if merged.MaxTokens == nil {
+			merged.MaxTokens = base.MaxTokens
+		}
+		if merged.Stop == nil {
+			merged.Stop = base.Stop
+		}
+		if merged.ReasoningEffort == "" {
+			merged.ReasoningEffort = base.ReasoningEffort
+		}
+		if merged.ContextStrategy == "" {
+			merged.ContextStrategy = base.ContextStrategy
+		}
+		if merged.FallbackModels == nil {
+			merged.FallbackModels = base.FallbackModels
+		}
+	}
+
+	if chat.SystemPrompt != "" {
+		prompts = append(prompts, chat.SystemPrompt)
+	}
+	merged.SystemPrompt = strings.Join(prompts, "\n\n")
+
+	return merged
+}
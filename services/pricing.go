@@ -0,0 +1,83 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// ModelPrice is expressed in USD per million tokens.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// PriceTable estimates the cost of a call from its token counts.
+type PriceTable struct {
+	mu     sync.RWMutex
+	prices map[string]ModelPrice
+}
+
+var defaultModelPrices = map[string]ModelPrice{
+	"google/gemini-2.0-flash-lite-001":  {Prompt: 0.075, Completion: 0.30},
+	"google/gemini-2.0-flash-001":       {Prompt: 0.10, Completion: 0.40},
+	"openai/gpt-4o":                     {Prompt: 2.50, Completion: 10.00},
+	"openai/gpt-4o-mini":                {Prompt: 0.15, Completion: 0.60},
+	"anthropic/claude-3.5-sonnet":       {Prompt: 3.00, Completion: 15.00},
+	"anthropic/claude-3.5-haiku":        {Prompt: 0.80, Completion: 4.00},
+	"meta-llama/llama-3.3-70b-instruct": {Prompt: 0.12, Completion: 0.30},
+	"deepseek/deepseek-chat":            {Prompt: 0.27, Completion: 1.10},
+}
+
+// LoadPriceTable starts from the built-in prices and overlays the JSON object
+// in path (model id to ModelPrice), if one is configured.
+func LoadPriceTable(path string) *PriceTable {
+	table := &PriceTable{prices: map[string]ModelPrice{}}
+	for model, price := range defaultModelPrices {
+		table.prices[model] = price
+	}
+
+	if path == "" {
+		return table
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read model price file %s: %v", path, err)
+		return table
+	}
+
+	var overrides map[string]ModelPrice
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		log.Printf("Failed to parse model price file %s: %v", path, err)
+		return table
+	}
+
+	table.Set(overrides)
+	return table
+}
+
+func (t *PriceTable) Set(prices map[string]ModelPrice) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for model, price := range prices {
+		t.prices[model] = price
+	}
+}
+
+func (t *PriceTable) Lookup(model string) (ModelPrice, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	price, ok := t.prices[model]
+	return price, ok
+}
+
+// EstimateCost returns 0 for models without a known price.
+func (t *PriceTable) EstimateCost(model string, usage TokenUsage) float64 {
+	price, ok := t.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1_000_000
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kapi/config"
+	"kapi/models"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const defaultProviderName = "openrouter"
+
+// ErrInvalidAPIKey is returned when a provider rejects a user's key.
+var ErrInvalidAPIKey = errors.New("the provider rejected the API key")
+
+// Provider is an LLM backend capable of streaming chat completions.
+type Provider interface {
+	Name() string
+	// RequiresUserKey reports whether calls must be authenticated with the
+	// user's OpenRouter key (or the server default key).
+	RequiresUserKey() bool
+	StreamChat(ctx context.Context, apiKey string, req *CompletionRequest, onDelta func(StreamDelta)) (*CompletionResult, error)
+	ListModels(ctx context.Context, apiKey string) ([]ModelInfo, error)
+	ValidateKey(ctx context.Context, apiKey string) error
+}
+
+type CompletionMessage struct {
+	Role    string
+	Content string
+	// Parts are binary attachments sent alongside Content to models that
+	// accept them.
+	Parts []ContentPart
+	// ToolCalls are set on assistant messages that called tools; tool
+	// results carry the ToolCallID and ToolName they answer.
+	ToolCalls  []models.ToolCall
+	ToolCallID string
+	ToolName   string
+}
+
+// ToolDefinition advertises a function the model may call. Parameters is a
+// JSON Schema object.
+type ToolDefinition struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+}
+
+// ContentPart is an image or file attached to a message.
+type ContentPart struct {
+	Type      string // "image" or "file"
+	MediaType string
+	FileName  string
+	Data      []byte
+}
+
+// dataURL encodes the part as a base64 data URL.
+func (p ContentPart) dataURL() string {
+	return "data:" + p.MediaType + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+}
+
+type CompletionRequest struct {
+	Model    string
+	Messages []CompletionMessage
+	// Sampling parameters; nil or empty values are left to the provider.
+	Temperature     *float64
+	TopP            *float64
+	MaxTokens       *int
+	Stop            []string
+	ReasoningEffort string
+	Tools           []ToolDefinition
+	ResponseFormat  *models.ResponseFormat
+}
+
+type StreamDelta struct {
+	Content   string
+	Reasoning string
+}
+
+type CompletionResult struct {
+	Model        string
+	FinishReason string
+	GenerationID string
+	Usage        TokenUsage
+	// ToolCalls requested by the model; FinishReason is then usually
+	// "tool_calls".
+	ToolCalls []models.ToolCall
+}
+
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	ReasoningTokens  int
+	TotalTokens      int
+	// Cost is the amount reported by the provider in USD, when available.
+	Cost float64
+	// Estimated is set when the provider reported no usage, as for a stream
+	// that was cancelled or broke off, and the counts were estimated.
+	Estimated bool
+}
+
+// add sums other into u. The sum is estimated if any part of it is.
+func (u *TokenUsage) add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.ReasoningTokens += other.ReasoningTokens
+	u.TotalTokens += other.TotalTokens
+	u.Cost += other.Cost
+	u.Estimated = u.Estimated || other.Estimated
+}
+
+type ModelInfo struct {
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Provider      string      `json:"provider"`
+	ContextLength int         `json:"context_length,omitempty"`
+	Pricing       *ModelPrice `json:"pricing,omitempty"`
+	// InputModalities lists accepted input types such as "text" and "image".
+	InputModalities []string `json:"input_modalities,omitempty"`
+	SupportsTools   bool     `json:"supports_tools"`
+	// SupportsResponseFormat is set for models that accept a JSON Schema
+	// response_format natively.
+	SupportsResponseFormat bool `json:"supports_response_format"`
+}
+
+type ProviderRegistry struct {
+	providers map[string]Provider
+	fallback  string
+}
+
+func NewProviderRegistry(cfg *config.Config) *ProviderRegistry {
+	client := newUpstreamClient(cfg.Upstream)
+
+	registry := &ProviderRegistry{
+		providers: map[string]Provider{},
+		fallback:  defaultProviderName,
+	}
+	registry.Register(NewOpenRouterProvider(cfg.OpenRouterBaseURL, client))
+
+	for _, p := range cfg.OpenAICompatibleProviders {
+		registry.Register(NewOpenAICompatibleProvider(p.Name, p.BaseURL, p.APIKey, client))
+	}
+
+	if cfg.OllamaBaseURL != "" {
+		registry.Register(NewOllamaProvider(cfg.OllamaBaseURL, client))
+	}
+
+	if cfg.FakeLLM.Enabled {
+		fake := NewFakeProvider(cfg.FakeLLM)
+		registry.Register(fake)
+		if cfg.FakeLLM.AsDefault {
+			registry.fallback = fake.Name()
+		}
+	}
+
+	return registry
+}
+
+func (r *ProviderRegistry) Register(p Provider) {
+	r.providers[p.Name()] = p
+}
+
+// All returns the registered providers ordered by name.
+func (r *ProviderRegistry) All() []Provider {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make([]Provider, 0, len(names))
+	for _, name := range names {
+		providers = append(providers, r.providers[name])
+	}
+	return providers
+}
+
+func (r *ProviderRegistry) Get(name string) (Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// ValidateUserKey checks a user's OpenRouter key with the provider before it
+// is stored. Keys the provider refuses yield ErrInvalidAPIKey.
+func (r *ProviderRegistry) ValidateUserKey(ctx context.Context, apiKey string) error {
+	p, ok := r.providers[defaultProviderName]
+	if !ok {
+		return nil
+	}
+
+	err := p.ValidateKey(ctx, apiKey)
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		switch providerErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("%w: %v", ErrInvalidAPIKey, err)
+		}
+	}
+	return err
+}
+
+// Resolve picks the provider for a model string. Models may be prefixed with a
+// registered provider name ("ollama:llama3", "internal:mixtral"); anything else
+// is sent to the fallback provider (OpenRouter unless the fake provider is
+// configured as default) unchanged.
+func (r *ProviderRegistry) Resolve(model string) (Provider, string, error) {
+	if idx := strings.Index(model, ":"); idx > 0 {
+		if p, ok := r.providers[model[:idx]]; ok {
+			return p, model[idx+1:], nil
+		}
+	}
+
+	p, ok := r.providers[r.fallback]
+	if !ok {
+		return nil, "", fmt.Errorf("no provider available for model %q", model)
+	}
+	return p, model, nil
+}
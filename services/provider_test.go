@@ -0,0 +1,37 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateUserKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Write([]byte(`{"data": {}}`))
+		case "Bearer flaky":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	registry := &ProviderRegistry{providers: map[string]Provider{}, fallback: defaultProviderName}
+	registry.Register(NewOpenRouterProvider(server.URL, server.Client()))
+
+	if err := registry.ValidateUserKey(context.Background(), "good"); err != nil {
+		t.Fatalf("expected the key to be accepted, got %v", err)
+	}
+	if err := registry.ValidateUserKey(context.Background(), "bad"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("expected ErrInvalidAPIKey, got %v", err)
+	}
+	err := registry.ValidateUserKey(context.Background(), "flaky")
+	if err == nil || errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("expected a provider failure, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"fmt"
+	"kapi/config"
+	"kapi/models"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// QuotaExceededError is returned by QuotaService.Check when a limit has been
+// reached. Token limits map to 429 and cost limits to 402.
+type QuotaExceededError struct {
+	Scope   string // "user" or "global"
+	Period  string // "daily" or "monthly"
+	Kind    string // "tokens" or "cost"
+	ResetAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Scope == "global" {
+		return fmt.Sprintf("the server's shared %s %s quota has been exhausted, please add your own OpenRouter API key", e.Period, quotaKindLabel(e.Kind))
+	}
+	return fmt.Sprintf("%s %s quota exceeded", e.Period, quotaKindLabel(e.Kind))
+}
+
+func (e *QuotaExceededError) StatusCode() int {
+	if e.Kind == "cost" {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusTooManyRequests
+}
+
+func quotaKindLabel(kind string) string {
+	if kind == "cost" {
+		return "spending"
+	}
+	return "token"
+}
+
+type QuotaService struct {
+	db  *gorm.DB
+	cfg config.QuotaConfig
+}
+
+func NewQuotaService(db *gorm.DB, cfg config.QuotaConfig) *QuotaService {
+	return &QuotaService{db: db, cfg: cfg}
+}
+
+type usageTotals struct {
+	Tokens int64
+	Cost   float64
+}
+
+// Check verifies that the user may start a new generation. sharedKey reports
+// whether the call would be billed to the operator's default key.
+func (qs *QuotaService) Check(userID uint, sharedKey bool) (*models.QuotaStatus, error) {
+	status := &models.QuotaStatus{}
+	if !sharedKey && !qs.cfg.ApplyToUserKeys {
+		return status, nil
+	}
+	status.Enforced = true
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	dayReset := dayStart.AddDate(0, 0, 1)
+	monthReset := monthStart.AddDate(0, 1, 0)
+
+	if sharedKey {
+		if err := qs.checkGlobal(dayStart, dayReset, "daily", qs.cfg.GlobalDailyTokens, qs.cfg.GlobalDailyCost); err != nil {
+			return status, err
+		}
+		if err := qs.checkGlobal(monthStart, monthReset, "monthly", qs.cfg.GlobalMonthlyTokens, qs.cfg.GlobalMonthlyCost); err != nil {
+			return status, err
+		}
+	}
+
+	if qs.cfg.UserDailyTokens > 0 || qs.cfg.UserDailyCost > 0 {
+		daily, err := qs.userTotals(userID, dayStart)
+		if err != nil {
+			return status, err
+		}
+		status.DailyTokensRemaining, status.DailyCostRemaining = remaining(daily, qs.cfg.UserDailyTokens, qs.cfg.UserDailyCost)
+		if err := exceeded("user", "daily", dayReset, status.DailyTokensRemaining, status.DailyCostRemaining); err != nil {
+			return status, err
+		}
+	}
+
+	if qs.cfg.UserMonthlyTokens > 0 || qs.cfg.UserMonthlyCost > 0 {
+		monthly, err := qs.userTotals(userID, monthStart)
+		if err != nil {
+			return status, err
+		}
+		status.MonthlyTokensRemaining, status.MonthlyCostRemaining = remaining(monthly, qs.cfg.UserMonthlyTokens, qs.cfg.UserMonthlyCost)
+		if err := exceeded("user", "monthly", monthReset, status.MonthlyTokensRemaining, status.MonthlyCostRemaining); err != nil {
+			return status, err
+		}
+	}
+
+	return status, nil
+}
+
+func (qs *QuotaService) checkGlobal(since, resetAt time.Time, period string, tokenLimit int64, costLimit float64) error {
+	if tokenLimit <= 0 && costLimit <= 0 {
+		return nil
+	}
+
+	totals, err := qs.totals(qs.db.Where("key_source = ?", models.KeySourceShared), since)
+	if err != nil {
+		return err
+	}
+
+	tokens, cost := remaining(totals, tokenLimit, costLimit)
+	return exceeded("global", period, resetAt, tokens, cost)
+}
+
+func (qs *QuotaService) userTotals(userID uint, since time.Time) (*usageTotals, error) {
+	query := qs.db.Where("user_id = ?", userID)
+	if !qs.cfg.ApplyToUserKeys {
+		query = query.Where("key_source = ?", models.KeySourceShared)
+	}
+	return qs.totals(query, since)
+}
+
+func (qs *QuotaService) totals(query *gorm.DB, since time.Time) (*usageTotals, error) {
+	var totals usageTotals
+	err := query.Model(&models.UsageRecord{}).
+		Where("created_at >= ?", since).
+		Select("COALESCE(SUM(total_tokens), 0) AS tokens, COALESCE(SUM(cost), 0) AS cost").
+		Scan(&totals).Error
+	return &totals, err
+}
+
+func remaining(totals *usageTotals, tokenLimit int64, costLimit float64) (*int64, *float64) {
+	var tokens *int64
+	var cost *float64
+	if tokenLimit > 0 {
+		left := tokenLimit - totals.Tokens
+		if left < 0 {
+			left = 0
+		}
+		tokens = &left
+	}
+	if costLimit > 0 {
+		left := costLimit - totals.Cost
+		if left < 0 {
+			left = 0
+		}
+		cost = &left
+	}
+	return tokens, cost
+}
+
+func exceeded(scope, period string, resetAt time.Time, tokens *int64, cost *float64) error {
+	if cost != nil && *cost <= 0 {
+		return &QuotaExceededError{Scope: scope, Period: period, Kind: "cost", ResetAt: resetAt}
+	}
+	if tokens != nil && *tokens <= 0 {
+		return &QuotaExceededError{Scope: scope, Period: period, Kind: "tokens", ResetAt: resetAt}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"kapi/config"
+)
+
+func TestRemainingClampsAtZeroAndSkipsUnsetLimits(t *testing.T) {
+	tokens, cost := remaining(&usageTotals{Tokens: 1500, Cost: 0.25}, 1000, 1)
+	if tokens == nil || *tokens != 0 {
+		t.Fatalf("tokens = %v, want 0", tokens)
+	}
+	if cost == nil || *cost != 0.75 {
+		t.Fatalf("cost = %v, want 0.75", cost)
+	}
+
+	tokens, cost = remaining(&usageTotals{Tokens: 10}, 0, 0)
+	if tokens != nil || cost != nil {
+		t.Fatal("expected no allowance without limits")
+	}
+}
+
+func TestExceededReportsCostBeforeTokens(t *testing.T) {
+	resetAt := time.Now().Add(time.Hour)
+	zeroTokens, zeroCost := int64(0), 0.0
+	someTokens, someCost := int64(5), 0.5
+
+	var quotaErr *QuotaExceededError
+	err := exceeded("user", "daily", resetAt, &zeroTokens, &zeroCost)
+	if !errors.As(err, &quotaErr) || quotaErr.Kind != "cost" || quotaErr.StatusCode() != http.StatusPaymentRequired {
+		t.Fatalf("expected a cost error, got %v", err)
+	}
+
+	err = exceeded("global", "monthly", resetAt, &zeroTokens, &someCost)
+	if !errors.As(err, &quotaErr) || quotaErr.Kind != "tokens" || quotaErr.StatusCode() != http.StatusTooManyRequests {
+		t.Fatalf("expected a token error, got %v", err)
+	}
+	if quotaErr.Scope != "global" || !quotaErr.ResetAt.Equal(resetAt) {
+		t.Fatalf("unexpected error %+v", quotaErr)
+	}
+
+	if err := exceeded("user", "daily", resetAt, &someTokens, &someCost); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := exceeded("user", "daily", resetAt, nil, nil); err != nil {
+		t.Fatalf("expected no error without limits, got %v", err)
+	}
+}
+
+func TestCheckIgnoresUserKeysByDefault(t *testing.T) {
+	// No database is needed: calls on the user's own key are not limited.
+	qs := NewQuotaService(nil, config.QuotaConfig{UserDailyTokens: 100})
+	status, err := qs.Check(1, false)
+	if err != nil || status.Enforced {
+		t.Fatalf("expected no enforcement, got %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kapi/models"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// modelTarget is a model resolved to the provider and key that serve it.
+type modelTarget struct {
+	model     string
+	provider  Provider
+	modelID   string
+	key       string
+	keySource string
+}
+
+// resolveTarget checks that the model may be used and finds its provider and
+// API key.
+func (cs *ChatService) resolveTarget(userID uint, model string) (*modelTarget, error) {
+	if err := cs.catalog.Check(model); err != nil {
+		return nil, err
+	}
+
+	provider, modelID, err := cs.providers.Resolve(model)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &modelTarget{model: model, provider: provider, modelID: modelID, keySource: models.KeySourceProvider}
+	if provider.RequiresUserKey() {
+		target.key, target.keySource, err = cs.getOpenRouterKey(userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get OpenRouter key: %v", err)
+		}
+	}
+	return target, nil
+}
+
+// fallbackModels returns the models to try after model fails: the chat's own
+// list, or the server-wide one. model itself is left out.
+func (cs *ChatService) fallbackModels(model string, settings *models.ChatSettings) []string {
+	candidates := settings.FallbackModels
+	if len(candidates) == 0 {
+		candidates = cs.retry.FallbackModels
+	}
+
+	var chain []string
+	for _, candidate := range candidates {
+		if candidate != model {
+			chain = append(chain, candidate)
+		}
+	}
+	return chain
+}
+
+// nextFallback resolves the first usable model of chain and returns it with
+// the models left after it. Models that are not allowed, cannot be resolved
+// or would exceed the user's quota are skipped.
+func (cs *ChatService) nextFallback(userID uint, chain []string) (*modelTarget, []string) {
+	for len(chain) > 0 {
+		model := chain[0]
+		chain = chain[1:]
+		target, err := cs.resolveTarget(userID, model)
+		if err == nil {
+			err = cs.checkTargetQuota(userID, target)
+		}
+		if err != nil {
+			log.Printf("Skipping fallback model %s: %v", model, err)
+			continue
+		}
+		return target, chain
+	}
+	return nil, nil
+}
+
+// isTransient reports whether a provider call failed in a way that may
+// succeed when repeated: rate limits, server errors, network failures and
+// timeouts.
+func isTransient(err error) bool {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		switch providerErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return providerErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrUpstreamTimeout)
+}
+
+// isProviderFailure reports whether another model might succeed where this
+// one failed: the provider answered with an error or could not be reached.
+func isProviderFailure(err error) bool {
+	var providerErr *ProviderError
+	return errors.As(err, &providerErr) || isTransient(err)
+}
+
+// backoff is the delay before retry number attempt (from zero): the initial
+// delay doubled per attempt, capped, plus up to 50% random jitter.
+func (cs *ChatService) backoff(attempt int) time.Duration {
+	delay := cs.retry.InitialBackoff
+	for i := 0; i < attempt && delay < cs.retry.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if cs.retry.MaxBackoff > 0 && delay > cs.retry.MaxBackoff {
+		delay = cs.retry.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// sleepContext waits for d unless ctx is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"kapi/config"
+	"kapi/models"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&ProviderError{StatusCode: 429}, true},
+		{&ProviderError{StatusCode: 408}, true},
+		{&ProviderError{StatusCode: 503}, true},
+		{&ProviderError{StatusCode: 400}, false},
+		{&ProviderError{StatusCode: 401}, false},
+		{fmt.Errorf("reading stream: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{context.Canceled, false},
+		{errors.New("invalid response"), false},
+	}
+	for _, tc := range cases {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	cs := &ChatService{retry: config.RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := cs.backoff(attempt); d < base || d > base+base/2 {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, d, base, base+base/2)
+			}
+		}
+	}
+
+	cs.retry = config.RetryConfig{}
+	if d := cs.backoff(3); d != 0 {
+		t.Fatalf("expected no delay without a configured backoff, got %s", d)
+	}
+}
+
+func TestFallbackModelsPreferChatListAndSkipCurrentModel(t *testing.T) {
+	cs := &ChatService{retry: config.RetryConfig{FallbackModels: []string{"a", "b"}}}
+
+	got := cs.fallbackModels("a", &models.ChatSettings{})
+	if len(got) != 1 || got[0] != "b" {
+		t.Fatalf("server fallbacks = %v", got)
+	}
+
+	got = cs.fallbackModels("a", &models.ChatSettings{FallbackModels: []string{"c", "a", "d"}})
+	if len(got) != 2 || got[0] != "c" || got[1] != "d" {
+		t.Fatalf("chat fallbacks = %v", got)
+	}
+}
+
+func TestSleepContextStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"fmt"
+	"html"
+	"kapi/models"
+	"log"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Matches are marked with control characters by ts_headline so that the
+// snippet can be HTML-escaped before the <mark> tags are added.
+const (
+	highlightStart = "\x01"
+	highlightStop  = "\x02"
+)
+
+const headlineOptions = `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", ` +
+	`MaxFragments=2, MaxWords=20, MinWords=8, FragmentDelimiter=" … "`
+
+var searchLanguagePattern = regexp.MustCompile(`^[a-z_]+$`)
+
+// SearchService runs PostgreSQL full-text searches over a user's chat titles
+// and messages.
+type SearchService struct {
+	db *gorm.DB
+	// language is the text search configuration, such as "english". It is
+	// part of the index expressions, so queries must use the same one.
+	language string
+}
+
+func NewSearchService(db *gorm.DB, language string) *SearchService {
+	if !searchLanguagePattern.MatchString(language) {
+		log.Printf("Invalid search language %q, using english", language)
+		language = "english"
+	}
+	return &SearchService{db: db, language: language}
+}
+
+// vector is the indexed tsvector expression for column.
+func (ss *SearchService) vector(column string) string {
+	return fmt.Sprintf("to_tsvector('%s'::regconfig, %s)", ss.language, column)
+}
+
+// EnsureIndexes creates the GIN indexes used by Search. They are built
+// concurrently so that existing deployments keep accepting writes.
+func (ss *SearchService) EnsureIndexes() error {
+	indexes := []struct{ name, table, column string }{
+		{"idx_messages_content_fts_" + ss.language, "messages", "content"},
+		{"idx_chats_title_fts_" + ss.language, "chats", "title"},
+	}
+
+	// Concurrent index builds cannot run inside a transaction.
+	db := ss.db.Session(&gorm.Session{SkipDefaultTransaction: true})
+	for _, index := range indexes {
+		// A concurrent build that was interrupted leaves an invalid index
+		// behind, which IF NOT EXISTS would keep.
+		var valid []bool
+		if err := db.Raw("SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass(?)", index.name).
+			Scan(&valid).Error; err != nil {
+			return err
+		}
+		if len(valid) > 0 && !valid[0] {
+			log.Printf("Rebuilding invalid search index %s", index.name)
+			if err := db.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + index.name).Error; err != nil {
+				return err
+			}
+		}
+
+		statement := fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s USING GIN (%s)",
+			index.name, index.table, ss.vector(index.column))
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the user's chats and messages matching q.Query, best
+// matches first. The query accepts web search syntax: quoted phrases, "or"
+// and a leading "-" to exclude words.
+func (ss *SearchService) Search(userID uint, q *models.SearchQuery) ([]models.SearchHit, error) {
+	tsquery := fmt.Sprintf("websearch_to_tsquery('%s'::regconfig, ?)", ss.language)
+
+	messages := []string{
+		"c.user_id = ?",
+		"c.deleted_at IS NULL",
+		"m.deleted_at IS NULL",
+		ss.vector("m.content") + " @@ q.query",
+	}
+	messageArgs := []interface{}{q.Query, userID}
+	if q.ChatID != nil {
+		messages = append(messages, "m.chat_id = ?")
+		messageArgs = append(messageArgs, *q.ChatID)
+	}
+	if q.Role != "" {
+		messages = append(messages, "m.role = ?")
+		messageArgs = append(messageArgs, q.Role)
+	}
+	if q.Model != "" {
+		messages = append(messages, "m.model = ?")
+		messageArgs = append(messageArgs, q.Model)
+	}
+	if q.From != nil {
+		messages = append(messages, "m.created_at >= ?")
+		messageArgs = append(messageArgs, *q.From)
+	}
+	if q.To != nil {
+		messages = append(messages, "m.created_at < ?")
+		messageArgs = append(messageArgs, *q.To)
+	}
+
+	hits := "SELECT 'message' AS type, m.chat_id, c.title AS chat_title, m.id AS message_id, " +
+		"m.role, m.model, m.content AS text, ts_rank(" + ss.vector("m.content") + ", q.query) AS rank, m.created_at " +
+		"FROM messages m JOIN chats c ON c.id = m.chat_id, " + tsquery + " AS q(query) " +
+		"WHERE " + strings.Join(messages, " AND ")
+	args := messageArgs
+
+	// Chat titles carry no role or model.
+	if q.Role == "" && q.Model == "" {
+		chats := []string{
+			"c.user_id = ?",
+			"c.deleted_at IS NULL",
+			ss.vector("c.title") + " @@ q.query",
+		}
+		chatArgs := []interface{}{q.Query, userID}
+		if q.ChatID != nil {
+			chats = append(chats, "c.id = ?")
+			chatArgs = append(chatArgs, *q.ChatID)
+		}
+		if q.From != nil {
+			chats = append(chats, "c.updated_at >= ?")
+			chatArgs = append(chatArgs, *q.From)
+		}
+		if q.To != nil {
+			chats = append(chats, "c.updated_at < ?")
+			chatArgs = append(chatArgs, *q.To)
+		}
+
+		hits += " UNION ALL SELECT 'chat', c.id, c.title, NULL, '', '', c.title, " +
+			"ts_rank(" + ss.vector("c.title") + ", q.query), c.updated_at " +
+			"FROM chats c, " + tsquery + " AS q(query) " +
+			"WHERE " + strings.Join(chats, " AND ")
+		args = append(args, chatArgs...)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	// Snippets are only built for the page being returned.
+	sql := "SELECT type, chat_id, chat_title, message_id, role, model, rank, created_at, " +
+		"ts_headline('" + ss.language + "'::regconfig, text, " + tsquery + ", ?) AS snippet " +
+		"FROM (" + hits + " ORDER BY rank DESC, created_at DESC LIMIT ? OFFSET ?) AS hits " +
+		"ORDER BY rank DESC, created_at DESC"
+	args = append([]interface{}{q.Query, headlineOptions}, append(args, limit, q.Offset)...)
+
+	var results []models.SearchHit
+	if err := ss.db.Raw(sql, args...).Scan(&results).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Snippet = highlight(results[i].Snippet)
+	}
+	return results, nil
+}
+
+// highlight escapes a ts_headline snippet for HTML and marks the matches.
+func highlight(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, highlightStart, "<mark>")
+	return strings.ReplaceAll(snippet, highlightStop, "</mark>")
+}
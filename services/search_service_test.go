@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"kapi/models"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestHighlightEscapesBeforeMarking(t *testing.T) {
+	got := highlight("<b>" + highlightStart + "match" + highlightStop + "</b> & more")
+	want := "&lt;b&gt;<mark>match</mark>&lt;/b&gt; &amp; more"
+	if got != want {
+		t.Fatalf("highlight = %q, want %q", got, want)
+	}
+}
+
+func TestNewSearchServiceRejectsInvalidLanguage(t *testing.T) {
+	if ss := NewSearchService(nil, "english'); DROP TABLE chats; --"); ss.language != "english" {
+		t.Fatalf("language = %q", ss.language)
+	}
+	if ss := NewSearchService(nil, "german"); ss.language != "german" {
+		t.Fatalf("language = %q", ss.language)
+	}
+}
+
+// dryRunDB builds statements without a database and records the last one.
+func dryRunDB(t *testing.T) (*gorm.DB, *string) {
+	t.Helper()
+	var sql string
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               sqlRecorder{Interface: logger.Discard, sql: &sql},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, &sql
+}
+
+type sqlRecorder struct {
+	logger.Interface
+	sql *string
+}
+
+func (r sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	*r.sql, _ = fc()
+}
+
+func TestSearchFiltersMessagesAndSkipsTitlesForRoleFilter(t *testing.T) {
+	db, sql := dryRunDB(t)
+	ss := NewSearchService(db, "english")
+	chatID := uint(7)
+
+	// Raw queries cannot run in dry run mode, but their SQL is still built.
+	if _, err := ss.Search(3, &models.SearchQuery{Query: "hello", ChatID: &chatID}); !errors.Is(err, gorm.ErrDryRunModeUnsupported) {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"c.user_id = 3", "m.chat_id = 7", "c.id = 7", "UNION ALL", "LIMIT 20 OFFSET 0"} {
+		if !strings.Contains(*sql, want) {
+			t.Errorf("query without role filter lacks %q:\n%s", want, *sql)
+		}
+	}
+
+	if _, err := ss.Search(3, &models.SearchQuery{Query: "hello", Role: "assistant", Limit: 5}); !errors.Is(err, gorm.ErrDryRunModeUnsupported) {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*sql, "m.role = 'assistant'") || strings.Contains(*sql, "UNION ALL") {
+		t.Errorf("role filtered query should only search messages:\n%s", *sql)
+	}
+}
+
+func TestEnsureIndexesChecksValidityFirst(t *testing.T) {
+	db, sql := dryRunDB(t)
+	ss := NewSearchService(db, "english")
+
+	if err := ss.EnsureIndexes(); !errors.Is(err, gorm.ErrDryRunModeUnsupported) {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*sql, "indisvalid") || !strings.Contains(*sql, "'idx_messages_content_fts_english'") {
+		t.Errorf("expected the index validity check, got:\n%s", *sql)
+	}
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kapi/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrObjectNotFound = errors.New("stored object not found")
+
+// Storage keeps the contents of uploaded files. Keys are generated by the
+// server and use "/" as separator.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func NewStorage(cfg config.AttachmentConfig) (Storage, error) {
+	switch cfg.Storage {
+	case "", "local":
+		return NewLocalStorage(cfg.Dir), nil
+	case "s3":
+		if cfg.S3.Bucket == "" {
+			return nil, errors.New("S3_BUCKET is required for s3 attachment storage")
+		}
+		return NewS3Storage(cfg.S3, &http.Client{Timeout: 60 * time.Second}), nil
+	default:
+		return nil, fmt.Errorf("unknown attachment storage %q", cfg.Storage)
+	}
+}
+
+// LocalStorage stores objects as files below a directory.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return file, err
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
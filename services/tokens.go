@@ -0,0 +1,13 @@
+package services
+
+import "unicode/utf8"
+
+// estimateTokens approximates the token count of text using the common
+// heuristic of roughly four characters per token.
+func estimateTokens(text string) int {
+	runes := utf8.RuneCountInString(text)
+	if runes == 0 {
+		return 0
+	}
+	return (runes + 3) / 4
+}
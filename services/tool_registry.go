@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kapi/config"
+	"kapi/models"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// maxToolOutput bounds the text a tool result adds to the conversation.
+const maxToolOutput = 16000
+
+// Tool is a function the server runs on behalf of the model.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON Schema of the arguments object.
+	Parameters map[string]interface{}
+	// Run executes a call for the user. The returned text is sent back to
+	// the model as the tool result.
+	Run func(ctx context.Context, userID uint, arguments json.RawMessage) (string, error)
+}
+
+// ToolRegistry holds the tools advertised to models that support function
+// calling.
+type ToolRegistry struct {
+	tools     map[string]*Tool
+	maxRounds int
+}
+
+// NewToolRegistry registers the built-in tools allowed by the configuration.
+func NewToolRegistry(db *gorm.DB, cfg config.ToolsConfig) *ToolRegistry {
+	registry := &ToolRegistry{tools: map[string]*Tool{}, maxRounds: cfg.MaxRounds}
+	if !cfg.Enabled {
+		return registry
+	}
+
+	disabled := map[string]bool{}
+	for _, name := range cfg.Disabled {
+		disabled[name] = true
+	}
+	for _, tool := range []*Tool{calculatorTool(), currentTimeTool(), searchChatsTool(db)} {
+		if !disabled[tool.Name] {
+			registry.Register(tool)
+		}
+	}
+	return registry
+}
+
+func (r *ToolRegistry) Register(tool *Tool) {
+	r.tools[tool.Name] = tool
+}
+
+// MaxRounds is the number of tool rounds allowed in a single reply.
+func (r *ToolRegistry) MaxRounds() int {
+	return r.maxRounds
+}
+
+// Definitions returns the registered tools ordered by name.
+func (r *ToolRegistry) Definitions() []ToolDefinition {
+	definitions := make([]ToolDefinition, 0, len(r.tools))
+	for _, tool := range r.tools {
+		definitions = append(definitions, ToolDefinition{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  tool.Parameters,
+		})
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// Execute runs a tool call. Failures are reported in the result text so the
+// model can recover, e.g. by fixing its arguments. A panicking tool fails
+// only its call.
+func (r *ToolRegistry) Execute(ctx context.Context, userID uint, call models.ToolCall) (output string) {
+	tool, ok := r.tools[call.Name]
+	if !ok {
+		return fmt.Sprintf("Error: unknown tool %q", call.Name)
+	}
+
+	arguments := json.RawMessage(call.Arguments)
+	if call.Arguments == "" {
+		arguments = json.RawMessage("{}")
+	}
+	if !json.Valid(arguments) {
+		return "Error: arguments are not valid JSON"
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("Tool %s panicked: %v\n%s", call.Name, recovered, debug.Stack())
+			output = "Error: the tool failed unexpectedly"
+		}
+	}()
+
+	output, err := tool.Run(ctx, userID, arguments)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return truncateRunes(output, maxToolOutput)
+}
+
+// flattenToolMessages rewrites tool calls and results in history as plain
+// assistant text, for requests that do not offer tools.
+func flattenToolMessages(messages []CompletionMessage) []CompletionMessage {
+	result := make([]CompletionMessage, 0, len(messages))
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "tool":
+			result = append(result, CompletionMessage{
+				Role:    "assistant",
+				Content: fmt.Sprintf("[Result of %s]\n%s", msg.ToolName, msg.Content),
+			})
+		case len(msg.ToolCalls) > 0:
+			content := msg.Content
+			for _, call := range msg.ToolCalls {
+				content = strings.TrimSpace(content + fmt.Sprintf("\n[Called %s with %s]", call.Name, call.Arguments))
+			}
+			msg.Content = content
+			msg.ToolCalls = nil
+			result = append(result, msg)
+		default:
+			result = append(result, msg)
+		}
+	}
+	return result
+}
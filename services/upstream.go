@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kapi/config"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrUpstreamTimeout is returned when a provider call exceeds the idle or
+// total timeout.
+var ErrUpstreamTimeout = errors.New("provider timed out")
+
+// newUpstreamClient returns the HTTP client shared by the LLM providers. It
+// sets no overall client timeout, which would cut off long streams. Instead
+// the transport bounds connecting, waiting for response headers, the silence
+// between streamed chunks and, optionally, the whole call.
+func newUpstreamClient(cfg config.UpstreamConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: &timeoutTransport{
+		base:  transport,
+		idle:  cfg.IdleTimeout,
+		total: cfg.TotalTimeout,
+	}}
+}
+
+// timeoutTransport cancels a request, including the reading of its body,
+// when no data arrives for idle or the call takes longer than total. Zero
+// disables either limit. Cancellation of the caller's context still applies.
+type timeoutTransport struct {
+	base  http.RoundTripper
+	idle  time.Duration
+	total time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+
+	var totalTimer *time.Timer
+	if t.total > 0 {
+		totalTimer = time.AfterFunc(t.total, func() {
+			cancel(fmt.Errorf("%w: no complete response within %s", ErrUpstreamTimeout, t.total))
+		})
+	}
+	stop := func() {
+		if totalTimer != nil {
+			totalTimer.Stop()
+		}
+		cancel(context.Canceled)
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		err = timeoutCause(ctx, err)
+		stop()
+		return nil, err
+	}
+
+	body := &timeoutBody{ReadCloser: resp.Body, ctx: ctx, idle: t.idle}
+	if t.idle > 0 {
+		body.timer = time.AfterFunc(t.idle, func() {
+			cancel(fmt.Errorf("%w: no data for %s", ErrUpstreamTimeout, t.idle))
+		})
+	}
+	body.stop = func() {
+		if body.timer != nil {
+			body.timer.Stop()
+		}
+		stop()
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// timeoutBody restarts the idle timer whenever data arrives and releases the
+// request's context when closed.
+type timeoutBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	idle  time.Duration
+	timer *time.Timer
+	stop  func()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer != nil {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF {
+		err = timeoutCause(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	return err
+}
+
+// timeoutCause replaces err with the timeout that cancelled ctx, if any, so
+// that callers see why the call was aborted.
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrUpstreamTimeout) {
+		return cause
+	}
+	return err
+}
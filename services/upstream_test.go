@@ -0,0 +1,78 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kapi/config"
+)
+
+// stallingServer sends one chunk, then waits for pause before sending the
+// rest.
+func stallingServer(pause time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(pause):
+		}
+		w.Write([]byte("second"))
+	}))
+}
+
+func readUpstream(t *testing.T, cfg config.UpstreamConfig, url string) (string, error) {
+	t.Helper()
+	resp, err := newUpstreamClient(cfg).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	server := stallingServer(time.Second)
+	defer server.Close()
+
+	body, err := readUpstream(t, config.UpstreamConfig{IdleTimeout: 50 * time.Millisecond}, server.URL)
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("expected an idle timeout, got %v", err)
+	}
+	if body != "first " {
+		t.Fatalf("expected the data before the stall, got %q", body)
+	}
+}
+
+func TestUpstreamTotalTimeout(t *testing.T) {
+	server := stallingServer(time.Second)
+	defer server.Close()
+
+	_, err := readUpstream(t, config.UpstreamConfig{TotalTimeout: 50 * time.Millisecond}, server.URL)
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("expected a total timeout, got %v", err)
+	}
+}
+
+func TestUpstreamTimeoutsAreRetried(t *testing.T) {
+	if !isTransient(fmt.Errorf("%w: no data for 1s", ErrUpstreamTimeout)) {
+		t.Fatal("expected a timed out call to be retried")
+	}
+}
+
+func TestUpstreamSlowStreamWithinLimits(t *testing.T) {
+	server := stallingServer(20 * time.Millisecond)
+	defer server.Close()
+
+	body, err := readUpstream(t, config.UpstreamConfig{IdleTimeout: time.Second, TotalTimeout: time.Second}, server.URL)
+	if err != nil || body != "first second" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"kapi/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidGroupBy = errors.New("group_by must be one of: day, model, chat")
+
+type UsageService struct {
+	db     *gorm.DB
+	prices *PriceTable
+}
+
+func NewUsageService(db *gorm.DB, prices *PriceTable) *UsageService {
+	return &UsageService{db: db, prices: prices}
+}
+
+// LLMCall describes a finished provider call to be written to the ledger.
+type LLMCall struct {
+	UserID    uint
+	ChatID    uint
+	MessageID uint
+	Provider  string
+	Model     string
+	KeySource string
+	Usage     TokenUsage
+	Latency   time.Duration
+	Err       error
+}
+
+// Record writes a ledger entry. Failures are logged rather than returned so
+// accounting problems never break a chat response.
+func (us *UsageService) Record(call LLMCall) *models.UsageRecord {
+	record := &models.UsageRecord{
+		UserID:           call.UserID,
+		Provider:         call.Provider,
+		Model:            call.Model,
+		KeySource:        call.KeySource,
+		PromptTokens:     call.Usage.PromptTokens,
+		CompletionTokens: call.Usage.CompletionTokens,
+		ReasoningTokens:  call.Usage.ReasoningTokens,
+		TotalTokens:      call.Usage.TotalTokens,
+		Estimated:        call.Usage.Estimated,
+		Cost:             us.cost(call.Model, call.Usage),
+		LatencyMs:        call.Latency.Milliseconds(),
+		Status:           models.UsageStatusSuccess,
+	}
+	if call.ChatID != 0 {
+		record.ChatID = &call.ChatID
+	}
+	if call.MessageID != 0 {
+		record.MessageID = &call.MessageID
+	}
+	if call.Err != nil {
+		record.Status = models.UsageStatusError
+		record.Error = call.Err.Error()
+	}
+
+	if err := us.db.Create(record).Error; err != nil {
+		log.Printf("Failed to record LLM usage for user %d: %v", call.UserID, err)
+	}
+	return record
+}
+
+// cost prefers the provider-reported amount and falls back to the price table.
+func (us *UsageService) cost(model string, usage TokenUsage) float64 {
+	if usage.Cost > 0 {
+		return usage.Cost
+	}
+	return us.prices.EstimateCost(model, usage)
+}
+
+func (us *UsageService) Summarize(userID uint, q *models.UsageQuery) ([]models.UsageSummary, *models.UsageSummary, error) {
+	var keyExpr string
+	switch q.GroupBy {
+	case "", "day":
+		keyExpr = "to_char(date_trunc('day', created_at), 'YYYY-MM-DD')"
+	case "model":
+		keyExpr = "model"
+	case "chat":
+		keyExpr = "COALESCE(CAST(chat_id AS TEXT), '')"
+	default:
+		return nil, nil, ErrInvalidGroupBy
+	}
+
+	const aggregates = "COUNT(*) AS requests, " +
+		"COUNT(*) FILTER (WHERE status = 'error') AS errors, " +
+		"COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens, " +
+		"COALESCE(SUM(completion_tokens), 0) AS completion_tokens, " +
+		"COALESCE(SUM(total_tokens), 0) AS total_tokens, " +
+		"COALESCE(SUM(cost), 0) AS cost"
+
+	var groups []models.UsageSummary
+	if err := us.filtered(userID, q).
+		Select(keyExpr + " AS key, " + aggregates).
+		Group("key").
+		Order("key ASC").
+		Scan(&groups).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var totals models.UsageSummary
+	if err := us.filtered(userID, q).
+		Select(aggregates).
+		Scan(&totals).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return groups, &totals, nil
+}
+
+func (us *UsageService) ListRecords(userID uint, q *models.UsageQuery, limit, offset int) ([]models.UsageRecord, error) {
+	var records []models.UsageRecord
+	query := us.filtered(userID, q).Order("created_at DESC")
+
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if offset > 0 {
+		query = query.Offset(offset)
+	}
+
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (us *UsageService) filtered(userID uint, q *models.UsageQuery) *gorm.DB {
+	query := us.db.Model(&models.UsageRecord{}).Where("user_id = ?", userID)
+	if q.ChatID != nil {
+		query = query.Where("chat_id = ?", *q.ChatID)
+	}
+	if q.Model != "" {
+		query = query.Where("model = ?", q.Model)
+	}
+	if q.From != nil {
+		query = query.Where("created_at >= ?", *q.From)
+	}
+	if q.To != nil {
+		query = query.Where("created_at < ?", *q.To)
+	}
+	return query
+}
@@ -67,6 +67,9 @@ func (s *UserService) UpdateUser(id uint, req *models.UpdateUserRequest) (*model
 	if req.Username != "" {
 		user.Username = req.Username
 	}
+	if req.CustomInstructions != nil {
+		user.CustomInstructions = *req.CustomInstructions
+	}
 
 	if err := s.db.Save(&user).Error; err != nil {
 		return nil, err